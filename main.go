@@ -3,14 +3,29 @@ package main
 import (
 	"context"
 	"github.com/practice/virtual-kubelet-practice/pkg/common"
+	"github.com/practice/virtual-kubelet-practice/pkg/health"
+	"github.com/practice/virtual-kubelet-practice/pkg/logging"
+	"github.com/practice/virtual-kubelet-practice/pkg/metrics"
 	"github.com/practice/virtual-kubelet-practice/pkg/providers"
+	"github.com/practice/virtual-kubelet-practice/pkg/tracing"
+	"github.com/practice/virtual-kubelet-practice/pkg/zone"
 	"github.com/sirupsen/logrus"
 	cli "github.com/virtual-kubelet/node-cli"
-	//"github.com/virtual-kubelet/node-cli/opts"
 	logruscli "github.com/virtual-kubelet/node-cli/logrus"
+	"github.com/virtual-kubelet/node-cli/opts"
 	"github.com/virtual-kubelet/node-cli/provider"
 	"github.com/virtual-kubelet/virtual-kubelet/log"
 	logruslogger "github.com/virtual-kubelet/virtual-kubelet/log/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+	"net/http"
+	"os"
+	"sync/atomic"
 )
 
 const (
@@ -19,7 +34,7 @@ const (
 )
 
 // 启动命令
-// go run main.go --provider example-provider --kubeconfig ./config/config.yaml --nodename mynode
+// go run main.go --provider cas-vk --kubeconfig ./config/config.yaml --provider-config ./config/provider.yaml --nodename mynode
 
 func main() {
 
@@ -28,17 +43,88 @@ func main() {
 
 	log.L = logruslogger.FromLogrus(logrus.NewEntry(logger))
 	logConfig := &logruscli.Config{LogLevel: "info"}
+	logOptions := &logging.Options{Format: "text"}
+	providerConfig := common.NewProviderConfig()
+	o := opts.New()
 
 	node, err := cli.New(ctx,
+		cli.WithBaseOpts(o),
 		cli.WithProvider(providerName, func(cfg provider.InitConfig) (provider.Provider, error) {
-			cfg.ConfigPath = "/root/.kube/config"
-			return providers.NewCasProvider(ctx, common.SetupConfig(cfg)), nil
+			config, err := common.SetupConfig(cfg, providerConfig)
+			if err != nil {
+				return nil, err
+			}
+			tracing.Setup(ctx, config.TraceEndpoint, providerName, config.TraceSampleRate)
+			// 在创建 provider 之前启动，这样等待下游集群时就绪探针也能反映进度。
+			// 就绪探针不依赖指标，地址与指标不同时单独监听
+			var started atomic.Value
+			if config.HealthAddr != config.MetricsAddr {
+				go health.Serve(ctx, config.HealthAddr)
+			}
+			if config.MetricsAddr != "" {
+				handlers := map[string]http.Handler{
+					// 手动触发一次容量全量重算，只接受 POST，避免被探针或爬虫的 GET 请求触发
+					"/recompute": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						if r.Method != http.MethodPost {
+							w.Header().Set("Allow", http.MethodPost)
+							w.WriteHeader(http.StatusMethodNotAllowed)
+							return
+						}
+						p, ok := started.Load().(*providers.CasProvider)
+						if !ok {
+							w.WriteHeader(http.StatusServiceUnavailable)
+							return
+						}
+						p.TriggerRecompute()
+						w.WriteHeader(http.StatusAccepted)
+					}),
+				}
+				if config.HealthAddr == config.MetricsAddr {
+					handlers["/readyz"] = health.Informers
+				}
+				go metrics.Serve(ctx, config.MetricsAddr, handlers)
+			}
+			client, err := newClient(o.KubeConfigPath)
+			if err != nil {
+				return nil, err
+			}
+			eb := record.NewBroadcaster()
+			eb.StartLogging(log.G(ctx).Infof)
+			eb.StartRecordingToSink(&corev1client.EventSinkImpl{Interface: client.CoreV1().Events(o.KubeNamespace)})
+			recorder := eb.NewRecorder(scheme.Scheme, corev1.EventSource{Component: providerName, Host: cfg.NodeName})
+			p, err := providers.NewCasProvider(ctx, config, recorder)
+			if err != nil {
+				return nil, err
+			}
+			if cfg.ConfigPath != "" {
+				err := p.WatchConfig(ctx, cfg.ConfigPath, func() (*common.ProviderConfig, error) {
+					return common.SetupConfig(cfg, providerConfig)
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+			started.Store(p)
+			if config.QuotaConfigMap != "" {
+				if err := p.WatchQuota(ctx, client, config.QuotaConfigMap); err != nil {
+					return nil, err
+				}
+			}
+			if config.ZoneLabel != "" {
+				go zone.NewRunner(p, client, o).Run(ctx)
+			}
+			return p, nil
 		}),
 		cli.WithKubernetesNodeVersion(k8sVersion),
 		// Adds flags and parsing for using logrus as the configured logger
 		cli.WithPersistentFlags(logConfig.FlagSet()),
+		cli.WithPersistentFlags(logOptions.FlagSet()),
+		cli.WithPersistentFlags(providerConfig.FlagSet()),
 		cli.WithPersistentPreRunCallback(func() error {
-			return logruscli.Configure(logConfig, logger)
+			if err := logruscli.Configure(logConfig, logger); err != nil {
+				return err
+			}
+			return logging.Configure(logOptions, logger)
 		}),
 	)
 
@@ -50,3 +136,18 @@ func main() {
 		panic(err)
 	}
 }
+
+// newClient 创建上游集群的客户端，kubeconfig 不存在时使用 in-cluster 配置，与 node-cli 一致
+func newClient(configPath string) (kubernetes.Interface, error) {
+	var config *rest.Config
+	var err error
+	if _, statErr := os.Stat(configPath); !os.IsNotExist(statErr) {
+		config, err = clientcmd.BuildConfigFromFlags("", configPath)
+	} else {
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
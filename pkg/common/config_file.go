@@ -0,0 +1,205 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+// providerConfigFile is the schema of the provider config file passed by --provider-config,
+// it may be YAML or JSON, durations are strings like 30s, unknown fields are rejected.
+// Fields left out keep the value of the corresponding flag or its default, and flags
+// set explicitly on the command line take precedence over the file.
+//
+//	kubeconfig: /etc/cas-vk/downstream.kubeconfig   # or server, tokenFile and caFile, in-cluster when all empty
+//	nodeSelector: pool=batch
+//	reservations:
+//	  cpu: "4"
+//	  memory: 8Gi
+//	namespaceMapping:
+//	  team-a: downstream-team-a
+//	features:
+//	  descheduler: false
+type providerConfigFile struct {
+	Kubeconfig       string              `json:"kubeconfig,omitempty"`
+	Server           string              `json:"server,omitempty"`
+	TokenFile        string              `json:"tokenFile,omitempty"`
+	CAFile           string              `json:"caFile,omitempty"`
+	Clusters         []string            `json:"clusters,omitempty"`
+	NodeSelector     *string             `json:"nodeSelector,omitempty"`
+	ExcludeTaints    []string            `json:"excludeTaints,omitempty"`
+	AggregateLabels  []string            `json:"aggregateLabels,omitempty"`
+	ZoneLabel        *string             `json:"zoneLabel,omitempty"`
+	Architecture     *string             `json:"architecture,omitempty"`
+	Reservations     corev1.ResourceList `json:"reservations,omitempty"`
+	NamespaceMapping map[string]string   `json:"namespaceMapping,omitempty"`
+	ResourceMappings []string            `json:"resourceMappings,omitempty"`
+	QuotaConfigMap   *string             `json:"quotaConfigMap,omitempty"`
+
+	Deschedule    *descheduleFile    `json:"deschedule,omitempty"`
+	ClusterHealth *clusterHealthFile `json:"clusterHealth,omitempty"`
+	Features      *featuresFile      `json:"features,omitempty"`
+	Tracing       *tracingFile       `json:"tracing,omitempty"`
+
+	CapacityRecomputeInterval *metav1.Duration `json:"capacityRecomputeInterval,omitempty"`
+	NodeUpdateWindow          *metav1.Duration `json:"nodeUpdateWindow,omitempty"`
+	NodePressureThreshold     *float64         `json:"nodePressureThreshold,omitempty"`
+	MetricsAddr               *string          `json:"metricsAddr,omitempty"`
+	HealthAddr                *string          `json:"healthAddr,omitempty"`
+	CacheSyncTimeout          *metav1.Duration `json:"cacheSyncTimeout,omitempty"`
+	CacheSyncRetries          *int             `json:"cacheSyncRetries,omitempty"`
+}
+
+type descheduleFile struct {
+	Interval  *metav1.Duration `json:"interval,omitempty"`
+	Threshold *metav1.Duration `json:"threshold,omitempty"`
+	MaxCount  *int             `json:"maxCount,omitempty"`
+}
+
+type clusterHealthFile struct {
+	Interval         *metav1.Duration `json:"interval,omitempty"`
+	FailureThreshold *int             `json:"failureThreshold,omitempty"`
+	FailoverTimeout  *metav1.Duration `json:"failoverTimeout,omitempty"`
+}
+
+type tracingFile struct {
+	Endpoint   *string  `json:"endpoint,omitempty"`
+	SampleRate *float64 `json:"sampleRate,omitempty"`
+}
+
+// featuresFile switches optional behaviours, turning one off is the same as setting its interval or timeout to 0
+type featuresFile struct {
+	Descheduler       *bool `json:"descheduler,omitempty"`
+	Failover          *bool `json:"failover,omitempty"`
+	CapacityRecompute *bool `json:"capacityRecompute,omitempty"`
+	MirrorEvents      *bool `json:"mirrorEvents,omitempty"`
+}
+
+// LoadFile reads the provider config file at path into c
+func (c *ProviderConfig) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read provider config %s: %v", path, err)
+	}
+	file := &providerConfigFile{}
+	if err := yaml.UnmarshalStrict(data, file); err != nil {
+		return fmt.Errorf("parse provider config %s: %v", path, err)
+	}
+	c.apply(file)
+	return nil
+}
+
+// apply copies the fields set in file unless the corresponding flag was set on the command line
+func (c *ProviderConfig) apply(file *providerConfigFile) {
+	set := func(flag string, ok bool, f func()) {
+		if !ok || c.flags != nil && c.flags.Changed(flag) {
+			return
+		}
+		f()
+	}
+	set("client-kubeconfig", file.Kubeconfig != "", func() { c.ClientConfig = file.Kubeconfig })
+	set("client-server", file.Server != "", func() { c.ClientServer = file.Server })
+	set("client-token-file", file.TokenFile != "", func() { c.ClientTokenFile = file.TokenFile })
+	set("client-ca-file", file.CAFile != "", func() { c.ClientCAFile = file.CAFile })
+	set("cluster-kubeconfig", file.Clusters != nil, func() { c.ClusterConfigs = file.Clusters })
+	set("node-selector", file.NodeSelector != nil, func() { c.NodeSelector = *file.NodeSelector })
+	set("exclude-taint", file.ExcludeTaints != nil, func() { c.ExcludeTaints = file.ExcludeTaints })
+	set("aggregate-label", file.AggregateLabels != nil, func() { c.AggregateLabels = file.AggregateLabels })
+	set("zone-label", file.ZoneLabel != nil, func() { c.ZoneLabel = *file.ZoneLabel })
+	set("architecture", file.Architecture != nil, func() { c.Architecture = *file.Architecture })
+	set("", file.Reservations != nil, func() { c.Reservations = file.Reservations })
+	set("", file.NamespaceMapping != nil, func() { c.NamespaceMapping = file.NamespaceMapping })
+	set("resource-mapping", file.ResourceMappings != nil, func() { c.ResourceMappings = file.ResourceMappings })
+	set("quota-configmap", file.QuotaConfigMap != nil, func() { c.QuotaConfigMap = *file.QuotaConfigMap })
+	set("capacity-recompute-interval", file.CapacityRecomputeInterval != nil, func() {
+		c.CapacityRecomputeInterval = file.CapacityRecomputeInterval.Duration
+	})
+	set("node-update-window", file.NodeUpdateWindow != nil, func() { c.NodeUpdateWindow = file.NodeUpdateWindow.Duration })
+	set("node-pressure-threshold", file.NodePressureThreshold != nil, func() {
+		c.NodePressureThreshold = *file.NodePressureThreshold
+	})
+	set("provider-metrics-addr", file.MetricsAddr != nil, func() { c.MetricsAddr = *file.MetricsAddr })
+	set("provider-health-addr", file.HealthAddr != nil, func() { c.HealthAddr = *file.HealthAddr })
+	set("cache-sync-timeout", file.CacheSyncTimeout != nil, func() { c.CacheSyncTimeout = file.CacheSyncTimeout.Duration })
+	set("cache-sync-retries", file.CacheSyncRetries != nil, func() { c.CacheSyncRetries = *file.CacheSyncRetries })
+	if d := file.Deschedule; d != nil {
+		set("deschedule-interval", d.Interval != nil, func() { c.DescheduleInterval = d.Interval.Duration })
+		set("deschedule-threshold", d.Threshold != nil, func() { c.DescheduleThreshold = d.Threshold.Duration })
+		set("max-deschedule-count", d.MaxCount != nil, func() { c.MaxDescheduleCount = *d.MaxCount })
+	}
+	if t := file.Tracing; t != nil {
+		set("otlp-endpoint", t.Endpoint != nil, func() { c.TraceEndpoint = *t.Endpoint })
+		set("otlp-sample-rate", t.SampleRate != nil, func() { c.TraceSampleRate = *t.SampleRate })
+	}
+	if h := file.ClusterHealth; h != nil {
+		set("cluster-health-interval", h.Interval != nil, func() { c.ClusterHealthInterval = h.Interval.Duration })
+		set("cluster-failure-threshold", h.FailureThreshold != nil, func() {
+			c.ClusterFailureThreshold = *h.FailureThreshold
+		})
+		set("cluster-failover-timeout", h.FailoverTimeout != nil, func() {
+			c.ClusterFailoverTimeout = h.FailoverTimeout.Duration
+		})
+	}
+	if f := file.Features; f != nil {
+		set("deschedule-interval", f.Descheduler != nil && !*f.Descheduler, func() { c.DescheduleInterval = 0 })
+		set("cluster-failover-timeout", f.Failover != nil && !*f.Failover, func() { c.ClusterFailoverTimeout = 0 })
+		set("capacity-recompute-interval", f.CapacityRecompute != nil && !*f.CapacityRecompute, func() {
+			c.CapacityRecomputeInterval = 0
+		})
+		set("mirror-client-events", f.MirrorEvents != nil, func() { c.MirrorClientEvents = *f.MirrorEvents })
+	}
+}
+
+// Validate checks that the config can be used to start the provider
+func (c *ProviderConfig) Validate() error {
+	var errs []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+	check(c.ClientTokenFile == "" || c.ClientServer != "", "client server is required with client token file")
+	check(c.DescheduleInterval >= 0, "deschedule interval must not be negative")
+	check(c.DescheduleThreshold > 0, "deschedule threshold must be positive")
+	check(c.MaxDescheduleCount >= 0, "max deschedule count must not be negative")
+	check(c.ClusterHealthInterval > 0, "cluster health interval must be positive")
+	check(c.ClusterFailureThreshold > 0, "cluster failure threshold must be positive")
+	check(c.ClusterFailoverTimeout >= 0, "cluster failover timeout must not be negative")
+	check(c.CapacityRecomputeInterval >= 0, "capacity recompute interval must not be negative")
+	check(c.CacheSyncTimeout > 0, "cache sync timeout must be positive")
+	check(c.CacheSyncRetries >= 0, "cache sync retries must not be negative")
+	check(c.NodeUpdateWindow >= 0, "node update window must not be negative")
+	check(c.NodePressureThreshold > 0 && c.NodePressureThreshold <= 1, "node pressure threshold must be in (0, 1]")
+	check(c.TraceSampleRate >= 0 && c.TraceSampleRate <= 1, "trace sample rate must be in [0, 1]")
+	check(c.HealthAddr != "", "health address is required to serve the readiness endpoint")
+	if c.NodeSelector != "" {
+		_, err := labels.Parse(c.NodeSelector)
+		check(err == nil, "invalid node selector %q: %v", c.NodeSelector, err)
+	}
+	for _, taint := range c.ExcludeTaints {
+		check(taint != "" && !strings.HasPrefix(taint, ":"), "invalid excluded taint %q", taint)
+	}
+	if _, err := ParseResourceMapping(c.ResourceMappings); err != nil {
+		check(false, "%v", err)
+	}
+	for name, quantity := range c.Reservations {
+		check(quantity.Sign() >= 0, "reservation of %s must not be negative", name)
+	}
+	downstream := map[string]string{}
+	for from, to := range c.NamespaceMapping {
+		check(from != "" && to != "", "invalid namespace mapping %q: %q", from, to)
+		if other, ok := downstream[to]; ok {
+			check(false, "namespaces %s and %s are both mapped to %s", other, from, to)
+		}
+		downstream[to] = from
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid provider config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package common
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "provider.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFileCommandLineFlagsWin(t *testing.T) {
+	c := NewProviderConfig()
+	flags := c.FlagSet()
+	if err := flags.Parse([]string{"--node-selector=pool=cli", "--deschedule-interval=2m"}); err != nil {
+		t.Fatal(err)
+	}
+	path := writeConfigFile(t, `
+nodeSelector: pool=file
+quotaConfigMap: kube-system/quota
+deschedule:
+  interval: 10m
+  maxCount: 7
+`)
+	if err := c.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.NodeSelector != "pool=cli" {
+		t.Errorf("NodeSelector = %q, want the command line value pool=cli", c.NodeSelector)
+	}
+	if c.DescheduleInterval != 2*time.Minute {
+		t.Errorf("DescheduleInterval = %v, want the command line value 2m", c.DescheduleInterval)
+	}
+	if c.QuotaConfigMap != "kube-system/quota" {
+		t.Errorf("QuotaConfigMap = %q, want the file value kube-system/quota", c.QuotaConfigMap)
+	}
+	if c.MaxDescheduleCount != 7 {
+		t.Errorf("MaxDescheduleCount = %d, want the file value 7", c.MaxDescheduleCount)
+	}
+}
+
+func TestLoadFileWithoutFlags(t *testing.T) {
+	c := NewProviderConfig()
+	path := writeConfigFile(t, "nodeSelector: pool=file\n")
+	if err := c.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if c.NodeSelector != "pool=file" {
+		t.Errorf("NodeSelector = %q, want pool=file", c.NodeSelector)
+	}
+}
@@ -1,16 +1,106 @@
 package common
 
 import (
+	"time"
+
+	"github.com/spf13/pflag"
 	"github.com/virtual-kubelet/node-cli/provider"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// DefaultDaemonEndpointPort kubelet 默认端口
+	DefaultDaemonEndpointPort = 10250
+	// DefaultDescheduleInterval 重调度检查的周期
+	DefaultDescheduleInterval = 30 * time.Second
+	// DefaultDescheduleThreshold pod 在下游处于 Pending 超过该时间后会被重调度
+	DefaultDescheduleThreshold = 5 * time.Minute
+	// DefaultMaxDescheduleCount 单个 pod 最多被重调度的次数
+	DefaultMaxDescheduleCount = 3
+	// DefaultClusterHealthInterval 下游集群健康检查的周期
+	DefaultClusterHealthInterval = 10 * time.Second
+	// DefaultClusterFailureThreshold 连续探测失败多少次后认为下游集群不可用
+	DefaultClusterFailureThreshold = 3
+	// DefaultClusterFailoverTimeout 下游集群不可用超过该时间后将其 pod 迁移到其他集群
+	DefaultClusterFailoverTimeout = 5 * time.Minute
+	// DefaultCapacityRecomputeInterval 全量重算虚拟节点容量的周期
+	DefaultCapacityRecomputeInterval = 5 * time.Minute
+	// DefaultNodeUpdateWindow 合并虚拟节点状态变化的时间窗口
+	DefaultNodeUpdateWindow = time.Second
+	// DefaultCacheSyncTimeout 启动时第一次等待下游 informer 同步的时间
+	DefaultCacheSyncTimeout = 30 * time.Second
+	// DefaultCacheSyncRetries 启动时等待下游 informer 同步的重试次数
+	DefaultCacheSyncRetries = 4
+	// DefaultTraceSampleRate 配置了 OTLP collector 时默认上报全部 trace
+	DefaultTraceSampleRate = 1.0
+	// DefaultNodePressureThreshold 下游节点中上报压力的比例达到该值时虚拟节点上报对应的压力
+	DefaultNodePressureThreshold = 0.5
+	// DefaultHealthAddr 就绪探针的默认监听地址
+	DefaultHealthAddr = ":8081"
 )
 
-// ProviderConfig provider 配置文件
+// ProviderConfig provider 配置，来自命令行参数和 --provider-config 指定的配置文件
 type ProviderConfig struct {
+	// ClientConfig 下游集群的 kubeconfig，与 node-cli 的 --kubeconfig（上游集群）分开配置，
+	// 为空时使用 ClientTokenFile，两者都为空时使用 in-cluster 配置
 	ClientConfig string
+	// ClientServer 使用 ClientTokenFile 时下游 apiserver 的地址
+	ClientServer string
+	// ClientTokenFile 下游集群的 bearer token 文件，轮换后自动重新读取
+	ClientTokenFile string
+	// ClientCAFile 使用 ClientTokenFile 时下游 apiserver 的 CA 证书
+	ClientCAFile string
+	// ClusterConfigs 下游集群的 kubeconfig，格式为 id=path 或 path，为空时只使用 ClientConfig
+	ClusterConfigs []string
+	// ClusterHealthInterval 下游集群健康检查周期
+	ClusterHealthInterval time.Duration
+	// ClusterFailureThreshold 连续探测失败多少次后认为集群不可用
+	ClusterFailureThreshold int
+	// ClusterFailoverTimeout 集群不可用超过该时间后在其他集群重建其 pod，为 0 时不迁移
+	ClusterFailoverTimeout time.Duration
+	// CapacityRecomputeInterval 根据下游节点全量重算虚拟节点容量的周期，修正增量维护产生的偏差
+	CapacityRecomputeInterval time.Duration
+	// NodeUpdateWindow 在该时间窗口内的多次节点状态变化只通知最新的一次，为 0 时不等待
+	NodeUpdateWindow time.Duration
+	// ResourceMappings 下游扩展资源在虚拟节点上的名称，格式为 downstream=upstream 或 downstream=upstream*scale，
+	// scale 为一个下游资源对应的上游资源数量，pod 的资源请求按相反方向转换
+	ResourceMappings []string
+	// Reservations 从虚拟节点容量中预留、不对上游开放的资源
+	Reservations corev1.ResourceList
+	// NamespaceMapping 上游 namespace 到下游 namespace 的映射，未列出的 namespace 使用同名 namespace
+	NamespaceMapping map[string]string
+	// QuotaConfigMap 上游集群中保存各 namespace 配额的 ConfigMap，格式为 namespace/name，为空时不限制
+	QuotaConfigMap string
+	// CacheSyncTimeout 启动时第一次等待下游集群可访问以及 informer 同步的时间，之后每次重试加倍
+	CacheSyncTimeout time.Duration
+	// CacheSyncRetries 启动时等待下游集群的重试次数，用完后启动失败
+	CacheSyncRetries int
+	// MirrorClientEvents 是否将下游集群中转发 pod 的事件转发到上游 pod 上
+	MirrorClientEvents bool
+	// TraceEndpoint 以 OTLP/HTTP 上报 trace 的 collector 地址，如 localhost:4318，为空时不上报
+	TraceEndpoint string
+	// TraceSampleRate 上报 trace 的采样比例
+	TraceSampleRate float64
+	// MetricsAddr provider 指标的监听地址，为空时不暴露
+	MetricsAddr string
+	// HealthAddr 就绪探针 /readyz 的监听地址，不能为空，与 MetricsAddr 相同时共用同一个端口
+	HealthAddr string
+	// NodePressureThreshold 下游节点中上报 Memory/Disk/PID 压力的比例达到该值时，虚拟节点上报对应压力
+	NodePressureThreshold float64
 	// NodeName 节点名
 	NodeName string
-	// OperatingSystem 启动节点的操作系统
+	// OperatingSystem 启动节点的操作系统，只有相同操作系统的下游节点提供容量
 	OperatingSystem string
+	// NodeSelector 选择为虚拟节点提供容量的下游节点的 label selector，为空时选择全部节点
+	NodeSelector string
+	// ExcludeTaints 带有这些污点的下游节点不提供容量，格式为 key 或 key:effect
+	ExcludeTaints []string
+	// AggregateLabels 所有提供容量的下游节点取值一致时发布到虚拟节点上的 label
+	AggregateLabels []string
+	// ZoneLabel 不为空时按下游节点该 label 的取值为每个 zone 启动一个虚拟节点
+	ZoneLabel string
+	// Architecture 虚拟节点的架构，为空时根据下游节点检测，设置后只有该架构的下游节点提供容量
+	Architecture string
 	// DaemonEndpointPort 默认端口 10250
 	DaemonEndpointPort int32
 	// InternalIp 地址
@@ -21,15 +111,129 @@ type ProviderConfig struct {
 	ResourceMemory string
 	// MaxPod 最大pod数
 	MaxPod string
+	// DescheduleInterval 重调度检查的周期，为 0 时关闭重调度
+	DescheduleInterval time.Duration
+	// DescheduleThreshold pod 在下游 Pending 或无法调度超过该时间后触发重调度
+	DescheduleThreshold time.Duration
+	// MaxDescheduleCount 单个 pod 最多重调度次数，超过后放弃
+	MaxDescheduleCount int
+
+	// flags 由 FlagSet 创建，命令行中显式设置的参数优先于配置文件
+	flags *pflag.FlagSet
 }
 
-// SetupConfig 设置配置文件
-func SetupConfig(cfg provider.InitConfig) *ProviderConfig {
+// NewProviderConfig returns a ProviderConfig filled with defaults
+func NewProviderConfig() *ProviderConfig {
 	return &ProviderConfig{
-		ClientConfig:       cfg.ConfigPath,
-		NodeName:           cfg.NodeName,
-		OperatingSystem:    cfg.OperatingSystem,
-		DaemonEndpointPort: cfg.DaemonPort,
-		InternalIp:         cfg.InternalIP,
+		DescheduleInterval:  DefaultDescheduleInterval,
+		DescheduleThreshold: DefaultDescheduleThreshold,
+		MaxDescheduleCount:  DefaultMaxDescheduleCount,
+
+		ClusterHealthInterval:   DefaultClusterHealthInterval,
+		ClusterFailureThreshold: DefaultClusterFailureThreshold,
+		ClusterFailoverTimeout:  DefaultClusterFailoverTimeout,
+		NodePressureThreshold:   DefaultNodePressureThreshold,
+
+		CapacityRecomputeInterval: DefaultCapacityRecomputeInterval,
+		NodeUpdateWindow:          DefaultNodeUpdateWindow,
+		CacheSyncTimeout:          DefaultCacheSyncTimeout,
+		CacheSyncRetries:          DefaultCacheSyncRetries,
+		MirrorClientEvents:        true,
+		TraceSampleRate:           DefaultTraceSampleRate,
+		HealthAddr:                DefaultHealthAddr,
+
+		AggregateLabels: []string{
+			corev1.LabelTopologyZone,
+			corev1.LabelTopologyRegion,
+			corev1.LabelInstanceTypeStable,
+			"nvidia.com/gpu.product",
+		},
+		ExcludeTaints: []string{
+			"node-role.kubernetes.io/master:NoSchedule",
+			"node-role.kubernetes.io/control-plane:NoSchedule",
+		},
+	}
+}
+
+// FlagSet creates a new flag set based on the current config
+func (c *ProviderConfig) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet("cas-vk", pflag.ContinueOnError)
+	flags.DurationVar(&c.DescheduleInterval, "deschedule-interval", c.DescheduleInterval,
+		"interval between checks for pods stuck in the downstream cluster, 0 disables rescheduling")
+	flags.DurationVar(&c.DescheduleThreshold, "deschedule-threshold", c.DescheduleThreshold,
+		"how long a forwarded pod may stay pending or unschedulable before it is rescheduled")
+	flags.IntVar(&c.MaxDescheduleCount, "max-deschedule-count", c.MaxDescheduleCount,
+		"maximum number of times a single pod is rescheduled before giving up")
+	flags.StringVar(&c.ClientConfig, "client-kubeconfig", c.ClientConfig,
+		"kubeconfig of the downstream cluster, exec and token file auth are supported, "+
+			"empty uses --client-token-file or the in-cluster config")
+	flags.StringVar(&c.ClientServer, "client-server", c.ClientServer,
+		"address of the downstream apiserver when --client-token-file is used")
+	flags.StringVar(&c.ClientTokenFile, "client-token-file", c.ClientTokenFile,
+		"bearer token file of the downstream cluster, reread when it is rotated")
+	flags.StringVar(&c.ClientCAFile, "client-ca-file", c.ClientCAFile,
+		"CA certificate of the downstream apiserver when --client-token-file is used")
+	flags.StringSliceVar(&c.ClusterConfigs, "cluster-kubeconfig", c.ClusterConfigs,
+		"kubeconfig of a downstream cluster in the form id=path or path, may be repeated")
+	flags.DurationVar(&c.ClusterHealthInterval, "cluster-health-interval", c.ClusterHealthInterval,
+		"interval between health checks of each downstream cluster")
+	flags.IntVar(&c.ClusterFailureThreshold, "cluster-failure-threshold", c.ClusterFailureThreshold,
+		"number of consecutive failed health checks before a downstream cluster is considered unreachable")
+	flags.DurationVar(&c.ClusterFailoverTimeout, "cluster-failover-timeout", c.ClusterFailoverTimeout,
+		"how long a downstream cluster may stay unreachable before its pods are recreated elsewhere, 0 disables failover")
+	flags.StringVar(&c.NodeSelector, "node-selector", c.NodeSelector,
+		"label selector of the downstream nodes contributing capacity to the virtual node, empty selects all nodes")
+	flags.StringSliceVar(&c.ExcludeTaints, "exclude-taint", c.ExcludeTaints,
+		"downstream nodes with this taint, in the form key or key:effect, do not contribute capacity, may be repeated")
+	flags.StringSliceVar(&c.AggregateLabels, "aggregate-label", c.AggregateLabels,
+		"label published on the virtual node when all contributing downstream nodes share its value, may be repeated")
+	flags.StringVar(&c.ZoneLabel, "zone-label", c.ZoneLabel,
+		"start one virtual node per distinct value of this downstream node label, e.g. topology.kubernetes.io/zone")
+	flags.StringVar(&c.Architecture, "architecture", c.Architecture,
+		"architecture of the downstream nodes backing the virtual node, detected from the downstream nodes when empty")
+	flags.DurationVar(&c.CapacityRecomputeInterval, "capacity-recompute-interval", c.CapacityRecomputeInterval,
+		"interval between full recomputations of the virtual node capacity from the downstream nodes")
+	flags.DurationVar(&c.NodeUpdateWindow, "node-update-window", c.NodeUpdateWindow,
+		"window in which changes of the virtual node status are coalesced into one update, 0 sends each change")
+	flags.StringSliceVar(&c.ResourceMappings, "resource-mapping", c.ResourceMappings,
+		"expose a downstream extended resource under another name, in the form downstream=upstream[*scale], "+
+			"e.g. nvidia.com/gpu=example.com/gpu or nvidia.com/mig-1g.5gb=example.com/gpu-slice, may be repeated")
+	flags.StringVar(&c.QuotaConfigMap, "quota-configmap", c.QuotaConfigMap,
+		"upstream configmap, in the form namespace/name, holding the per-namespace quota on the virtual node, empty disables quotas")
+	flags.DurationVar(&c.CacheSyncTimeout, "cache-sync-timeout", c.CacheSyncTimeout,
+		"how long to wait at startup for a downstream cluster and its informers before retrying, doubled on each retry")
+	flags.IntVar(&c.CacheSyncRetries, "cache-sync-retries", c.CacheSyncRetries,
+		"number of retries at startup before giving up on a downstream cluster")
+	flags.BoolVar(&c.MirrorClientEvents, "mirror-client-events", c.MirrorClientEvents,
+		"mirror events of forwarded pods in the downstream clusters onto the upstream pods")
+	flags.StringVar(&c.TraceEndpoint, "otlp-endpoint", c.TraceEndpoint,
+		"OTLP/HTTP collector to export traces of pod operations to, e.g. localhost:4318, empty disables tracing")
+	flags.Float64Var(&c.TraceSampleRate, "otlp-sample-rate", c.TraceSampleRate,
+		"fraction of pod operations to trace when an OTLP endpoint is set")
+	flags.StringVar(&c.MetricsAddr, "provider-metrics-addr", c.MetricsAddr,
+		"address to serve provider metrics and the /recompute endpoint on, e.g. :9100, empty disables it")
+	flags.StringVar(&c.HealthAddr, "provider-health-addr", c.HealthAddr,
+		"address to serve the /readyz endpoint on, may be the same as --provider-metrics-addr")
+	flags.Float64Var(&c.NodePressureThreshold, "node-pressure-threshold", c.NodePressureThreshold,
+		"fraction of downstream nodes reporting memory, disk or PID pressure at which the virtual node reports it too")
+	c.flags = flags
+	return flags
+}
+
+// SetupConfig 合并命令行参数、cfg.ConfigPath 指定的配置文件以及 node-cli 的配置并校验
+func SetupConfig(cfg provider.InitConfig, base *ProviderConfig) (*ProviderConfig, error) {
+	c := *base
+	if cfg.ConfigPath != "" {
+		if err := c.LoadFile(cfg.ConfigPath); err != nil {
+			return nil, err
+		}
+	}
+	c.NodeName = cfg.NodeName
+	c.OperatingSystem = cfg.OperatingSystem
+	c.DaemonEndpointPort = cfg.DaemonPort
+	c.InternalIp = cfg.InternalIP
+	if err := c.Validate(); err != nil {
+		return nil, err
 	}
+	return &c, nil
 }
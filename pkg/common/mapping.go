@@ -0,0 +1,160 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// ResourceMappingRule exposes a downstream extended resource under another name on the virtual node
+type ResourceMappingRule struct {
+	// Downstream is the resource name on the downstream nodes
+	Downstream corev1.ResourceName
+	// Upstream is the resource name on the virtual node
+	Upstream corev1.ResourceName
+	// Scale is the number of upstream units provided by one downstream unit
+	Scale int64
+}
+
+// ResourceMapping is a list of ResourceMappingRule, several downstream resources
+// may be mapped to the same upstream resource
+type ResourceMapping []ResourceMappingRule
+
+// ParseResourceMapping parses rules in the form downstream=upstream or downstream=upstream*scale
+func ParseResourceMapping(specs []string) (ResourceMapping, error) {
+	var mapping ResourceMapping
+	for _, spec := range specs {
+		i := strings.Index(spec, "=")
+		if i <= 0 || i == len(spec)-1 {
+			return nil, fmt.Errorf("invalid resource mapping %q, expect downstream=upstream[*scale]", spec)
+		}
+		rule := ResourceMappingRule{Downstream: corev1.ResourceName(spec[:i]), Scale: 1}
+		upstream := spec[i+1:]
+		if j := strings.LastIndex(upstream, "*"); j > 0 {
+			scale, err := strconv.ParseInt(upstream[j+1:], 10, 64)
+			if err != nil || scale <= 0 {
+				return nil, fmt.Errorf("invalid scale of resource mapping %q", spec)
+			}
+			rule.Scale, upstream = scale, upstream[:j]
+		}
+		rule.Upstream = corev1.ResourceName(upstream)
+		mapping = append(mapping, rule)
+	}
+	return mapping, nil
+}
+
+func (m ResourceMapping) byDownstream(name corev1.ResourceName) (ResourceMappingRule, bool) {
+	for _, rule := range m {
+		if rule.Downstream == name {
+			return rule, true
+		}
+	}
+	return ResourceMappingRule{}, false
+}
+
+// ToUpstream converts the downstream resources to the resources advertised on the virtual node
+func (m ResourceMapping) ToUpstream(r *Resource) *Resource {
+	if len(m) == 0 {
+		return r
+	}
+	return ConvertResource(m.ListToUpstream(r.List()))
+}
+
+// ListToUpstream renames and scales the mapped resources in list, resources mapped
+// to the same upstream name are summed up. Quantities are scaled in milli units so
+// fractional quantities are not rounded
+func (m ResourceMapping) ListToUpstream(list corev1.ResourceList) corev1.ResourceList {
+	if len(m) == 0 || list == nil {
+		return list
+	}
+	converted := corev1.ResourceList{}
+	for name, quantity := range list {
+		if rule, ok := m.byDownstream(name); ok {
+			name = rule.Upstream
+			quantity = *resource.NewMilliQuantity(quantity.MilliValue()*rule.Scale, quantity.Format)
+		}
+		if old, ok := converted[name]; ok {
+			quantity.Add(old)
+		}
+		converted[name] = quantity
+	}
+	return converted
+}
+
+// ListToDownstream converts the upstream resources in list back to downstream resources,
+// available reports whether the downstream cluster provides a resource and chooses
+// between several downstream resources mapped to the same upstream name. A quantity that
+// does not convert to a whole number of the downstream resource is rejected instead of
+// rounded, only cpu may be fractional
+func (m ResourceMapping) ListToDownstream(list corev1.ResourceList, available func(corev1.ResourceName) bool) (
+	corev1.ResourceList, error) {
+	if len(m) == 0 || list == nil {
+		return list, nil
+	}
+	converted := corev1.ResourceList{}
+	for name, quantity := range list {
+		rule, ok := m.byUpstream(name, available)
+		if !ok {
+			converted[name] = quantity
+			continue
+		}
+		milli := quantity.MilliValue()
+		if milli%rule.Scale != 0 || rule.Downstream != corev1.ResourceCPU && milli/rule.Scale%1000 != 0 {
+			return nil, fmt.Errorf("%s %s is not a multiple of %d required by %s", name, quantity.String(), rule.Scale, rule.Downstream)
+		}
+		converted[rule.Downstream] = *resource.NewMilliQuantity(milli/rule.Scale, quantity.Format)
+	}
+	return converted, nil
+}
+
+// byUpstream returns the rule of the upstream resource, preferring one whose downstream resource is available
+func (m ResourceMapping) byUpstream(name corev1.ResourceName, available func(corev1.ResourceName) bool) (
+	ResourceMappingRule, bool) {
+	var found *ResourceMappingRule
+	for i := range m {
+		if m[i].Upstream != name {
+			continue
+		}
+		if available == nil || available(m[i].Downstream) {
+			return m[i], true
+		}
+		if found == nil {
+			found = &m[i]
+		}
+	}
+	if found == nil {
+		return ResourceMappingRule{}, false
+	}
+	return *found, true
+}
+
+// PodToDownstream converts the resources of the containers in pod to downstream resources,
+// resources already named after a downstream resource are converted to upstream first
+// so pods moved between clusters are mapped to the resources of the new cluster
+func (m ResourceMapping) PodToDownstream(pod *corev1.Pod, available func(corev1.ResourceName) bool) error {
+	if len(m) == 0 {
+		return nil
+	}
+	convert := func(containers []corev1.Container) error {
+		for i := range containers {
+			resources := &containers[i].Resources
+			requests, err := m.ListToDownstream(m.ListToUpstream(resources.Requests), available)
+			if err != nil {
+				return fmt.Errorf("container %s: %v", containers[i].Name, err)
+			}
+			limits, err := m.ListToDownstream(m.ListToUpstream(resources.Limits), available)
+			if err != nil {
+				return fmt.Errorf("container %s: %v", containers[i].Name, err)
+			}
+			resources.Requests, resources.Limits = requests, limits
+		}
+		return nil
+	}
+	if err := convert(pod.Spec.InitContainers); err != nil {
+		return err
+	}
+	return convert(pod.Spec.Containers)
+}
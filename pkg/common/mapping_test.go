@@ -0,0 +1,214 @@
+package common
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func mustParseResourceMapping(t *testing.T, specs ...string) ResourceMapping {
+	t.Helper()
+	mapping, err := ParseResourceMapping(specs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mapping
+}
+
+func resourceList(pairs ...string) corev1.ResourceList {
+	list := corev1.ResourceList{}
+	for i := 0; i < len(pairs); i += 2 {
+		list[corev1.ResourceName(pairs[i])] = resource.MustParse(pairs[i+1])
+	}
+	return list
+}
+
+func equalResourceList(a, b corev1.ResourceList) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, quantity := range a {
+		other, ok := b[name]
+		if !ok || quantity.Cmp(other) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestParseResourceMapping(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    ResourceMappingRule
+		wantErr bool
+	}{
+		{spec: "example.com/gpu=gpu", want: ResourceMappingRule{Downstream: "example.com/gpu", Upstream: "gpu", Scale: 1}},
+		{spec: "example.com/gpu=gpu*4", want: ResourceMappingRule{Downstream: "example.com/gpu", Upstream: "gpu", Scale: 4}},
+		{spec: "example.com/gpu=gpu*0.5", wantErr: true},
+		{spec: "example.com/gpu=gpu*0", wantErr: true},
+		{spec: "example.com/gpu=", wantErr: true},
+		{spec: "=gpu", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			mapping, err := ParseResourceMapping([]string{tt.spec})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parse %q succeeded with %+v, want error", tt.spec, mapping)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(mapping) != 1 || mapping[0] != tt.want {
+				t.Fatalf("mapping = %+v, want %+v", mapping, tt.want)
+			}
+		})
+	}
+}
+
+func TestResourceMappingRoundTrip(t *testing.T) {
+	tests := []struct {
+		name         string
+		specs        []string
+		downstream   corev1.ResourceList
+		wantUpstream corev1.ResourceList
+	}{
+		{
+			name:         "rename",
+			specs:        []string{"example.com/gpu=gpu"},
+			downstream:   resourceList("example.com/gpu", "2", "cpu", "4"),
+			wantUpstream: resourceList("gpu", "2", "cpu", "4"),
+		},
+		{
+			name:         "scale up",
+			specs:        []string{"example.com/gpu=gpu-slice*4"},
+			downstream:   resourceList("example.com/gpu", "3"),
+			wantUpstream: resourceList("gpu-slice", "12"),
+		},
+		{
+			name:         "fractional quantity",
+			specs:        []string{"cpu=vcpu*2"},
+			downstream:   resourceList("cpu", "1500m"),
+			wantUpstream: resourceList("vcpu", "3"),
+		},
+		{
+			name:         "sub-unit quantity",
+			specs:        []string{"cpu=vcpu*3"},
+			downstream:   resourceList("cpu", "250m"),
+			wantUpstream: resourceList("vcpu", "750m"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mapping := mustParseResourceMapping(t, tt.specs...)
+			upstream := mapping.ListToUpstream(tt.downstream)
+			if !equalResourceList(upstream, tt.wantUpstream) {
+				t.Fatalf("upstream = %v, want %v", upstream, tt.wantUpstream)
+			}
+			downstream, err := mapping.ListToDownstream(upstream, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalResourceList(downstream, tt.downstream) {
+				t.Fatalf("downstream = %v, want %v", downstream, tt.downstream)
+			}
+		})
+	}
+}
+
+func TestListToDownstream(t *testing.T) {
+	mapping := mustParseResourceMapping(t, "example.com/gpu=gpu-slice*4", "other.com/gpu=gpu-slice*2", "cpu=vcpu*2")
+	tests := []struct {
+		name      string
+		upstream  corev1.ResourceList
+		available func(corev1.ResourceName) bool
+		want      corev1.ResourceList
+		wantErr   bool
+	}{
+		{
+			name:     "scale down",
+			upstream: resourceList("gpu-slice", "8", "memory", "1Gi"),
+			want:     resourceList("example.com/gpu", "2", "memory", "1Gi"),
+		},
+		{
+			name:     "uneven quantity",
+			upstream: resourceList("gpu-slice", "6"),
+			wantErr:  true,
+		},
+		{
+			name:     "fractional quantity",
+			upstream: resourceList("vcpu", "1"),
+			want:     resourceList("cpu", "500m"),
+		},
+		{
+			name:     "uneven milli quantity",
+			upstream: resourceList("vcpu", "1m"),
+			wantErr:  true,
+		},
+		{
+			name:      "prefer available downstream resource",
+			upstream:  resourceList("gpu-slice", "6"),
+			available: func(name corev1.ResourceName) bool { return name == "other.com/gpu" },
+			want:      resourceList("other.com/gpu", "3"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mapping.ListToDownstream(tt.upstream, tt.available)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("converted to %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalResourceList(got, tt.want) {
+				t.Fatalf("downstream = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPodToDownstream(t *testing.T) {
+	mapping := mustParseResourceMapping(t, "example.com/gpu=gpu-slice*4", "other.com/gpu=gpu-slice*2")
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		InitContainers: []corev1.Container{{
+			Name:      "setup",
+			Resources: corev1.ResourceRequirements{Requests: resourceList("gpu-slice", "4")},
+		}},
+		Containers: []corev1.Container{{
+			Name: "app",
+			// moved from a cluster providing example.com/gpu
+			Resources: corev1.ResourceRequirements{
+				Requests: resourceList("example.com/gpu", "1", "cpu", "1"),
+				Limits:   resourceList("example.com/gpu", "1"),
+			},
+		}},
+	}}
+	available := func(name corev1.ResourceName) bool { return name == "other.com/gpu" }
+	if err := mapping.PodToDownstream(pod, available); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pod.Spec.InitContainers[0].Resources.Requests, resourceList("other.com/gpu", "2"); !equalResourceList(got, want) {
+		t.Errorf("init container requests = %v, want %v", got, want)
+	}
+	if got, want := pod.Spec.Containers[0].Resources.Requests, resourceList("other.com/gpu", "2", "cpu", "1"); !equalResourceList(got, want) {
+		t.Errorf("container requests = %v, want %v", got, want)
+	}
+	if got, want := pod.Spec.Containers[0].Resources.Limits, resourceList("other.com/gpu", "2"); !equalResourceList(got, want) {
+		t.Errorf("container limits = %v, want %v", got, want)
+	}
+
+	uneven := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{
+		Name:      "app",
+		Resources: corev1.ResourceRequirements{Requests: resourceList("gpu-slice", "3")},
+	}}}}
+	if err := mapping.PodToDownstream(uneven, available); err == nil {
+		t.Errorf("pod requesting 3 gpu-slice converted to %v, want error", uneven.Spec.Containers[0].Resources.Requests)
+	}
+}
@@ -11,6 +11,8 @@ import (
 type ProviderNode struct {
 	sync.Mutex
 	*corev1.Node
+	// managedLabels the managed keys of the last SetLabels call
+	managedLabels []string
 }
 
 // AddResource add resource to the node
@@ -41,6 +43,87 @@ func (n *ProviderNode) SubResource(resource *Resource) error {
 	return nil
 }
 
+// SetResource replace the capacity of the node with resource
+func (n *ProviderNode) SetResource(resource *Resource) error {
+	if n.Node == nil {
+		return fmt.Errorf("ProviderNode node has not init")
+	}
+	n.Lock()
+	defer n.Unlock()
+	resource.SetCapacityToNode(n.Node)
+	return nil
+}
+
+// SetConditions replace the conditions of the node
+func (n *ProviderNode) SetConditions(conditions []corev1.NodeCondition) error {
+	if n.Node == nil {
+		return fmt.Errorf("ProviderNode node has not init")
+	}
+	n.Lock()
+	defer n.Unlock()
+	n.Status.Conditions = conditions
+	return nil
+}
+
+// SetLabels set labels of the node, keys in managed but not in labels are removed,
+// so are keys managed by the previous call but no longer in managed
+func (n *ProviderNode) SetLabels(managed []string, labels map[string]string) error {
+	if n.Node == nil {
+		return fmt.Errorf("ProviderNode node has not init")
+	}
+	n.Lock()
+	defer n.Unlock()
+	if n.Labels == nil {
+		n.Labels = map[string]string{}
+	}
+	for _, key := range n.managedLabels {
+		delete(n.Labels, key)
+	}
+	for _, key := range managed {
+		delete(n.Labels, key)
+	}
+	for key, value := range labels {
+		n.Labels[key] = value
+	}
+	n.managedLabels = append([]string(nil), managed...)
+	return nil
+}
+
+// SetAnnotation set an annotation of the node, an empty value removes it
+func (n *ProviderNode) SetAnnotation(key, value string) error {
+	if n.Node == nil {
+		return fmt.Errorf("ProviderNode node has not init")
+	}
+	n.Lock()
+	defer n.Unlock()
+	if value == "" {
+		delete(n.Annotations, key)
+		return nil
+	}
+	if n.Annotations == nil {
+		n.Annotations = map[string]string{}
+	}
+	n.Annotations[key] = value
+	return nil
+}
+
+// SetArchitecture set the architecture of the node, and the labels with keys to it
+func (n *ProviderNode) SetArchitecture(arch string, keys ...string) error {
+	if n.Node == nil {
+		return fmt.Errorf("ProviderNode node has not init")
+	}
+	n.Lock()
+	defer n.Unlock()
+	n.Status.NodeInfo.Architecture = arch
+	if n.Labels == nil {
+		n.Labels = map[string]string{}
+	}
+	for _, key := range keys {
+		n.Labels[key] = arch
+	}
+	return nil
+}
+
 // DeepCopy deepcopy node with lock, to avoid concurrent read-write
 func (n *ProviderNode) DeepCopy() *corev1.Node {
 	n.Lock()
@@ -0,0 +1,58 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// NodeNotifier keeps only the latest node status and delivers it after a coalescing window,
+// Notify never blocks so it is safe to call from informer event handlers
+type NodeNotifier struct {
+	lock   sync.Mutex
+	latest *corev1.Node
+	signal chan struct{}
+}
+
+// NewNodeNotifier returns an empty NodeNotifier
+func NewNodeNotifier() *NodeNotifier {
+	return &NodeNotifier{signal: make(chan struct{}, 1)}
+}
+
+// Notify replaces the pending node status with node
+func (n *NodeNotifier) Notify(node *corev1.Node) {
+	n.lock.Lock()
+	n.latest = node
+	n.lock.Unlock()
+	select {
+	case n.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Run calls f with the latest node status at most once per window until ctx is done
+func (n *NodeNotifier) Run(ctx context.Context, window time.Duration, f func(*corev1.Node)) {
+	for {
+		select {
+		case <-n.signal:
+		case <-ctx.Done():
+			return
+		}
+		if window > 0 {
+			select {
+			case <-time.After(window):
+			case <-ctx.Done():
+				return
+			}
+		}
+		n.lock.Lock()
+		node := n.latest
+		n.latest = nil
+		n.lock.Unlock()
+		if node != nil {
+			f(node)
+		}
+	}
+}
@@ -1,9 +1,10 @@
 package common
 
 import (
+	"strings"
+
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
-	"k8s.io/klog"
 )
 
 // CustomResources is a key-value map for defining custom resources
@@ -35,6 +36,40 @@ func (cr CustomResources) Equal(other CustomResources) bool {
 	return true
 }
 
+// add returns cr with each quantity of other added
+func (cr CustomResources) add(other CustomResources) CustomResources {
+	return cr.merge(other, func(q *resource.Quantity, o resource.Quantity) { q.Add(o) })
+}
+
+// sub returns cr with each quantity of other subtracted
+func (cr CustomResources) sub(other CustomResources) CustomResources {
+	return cr.merge(other, func(q *resource.Quantity, o resource.Quantity) { q.Sub(o) })
+}
+
+// setMax returns cr with each quantity set to the max of itself and other
+func (cr CustomResources) setMax(other CustomResources) CustomResources {
+	return cr.merge(other, func(q *resource.Quantity, o resource.Quantity) {
+		if o.Cmp(*q) > 0 {
+			*q = o
+		}
+	})
+}
+
+func (cr CustomResources) merge(other CustomResources, f func(*resource.Quantity, resource.Quantity)) CustomResources {
+	if len(other) == 0 {
+		return cr
+	}
+	if cr == nil {
+		cr = CustomResources{}
+	}
+	for name, quota := range other {
+		old := cr[name]
+		f(&old, quota)
+		cr[name] = old
+	}
+	return cr
+}
+
 // Resource defines the resources of a pod, it provides func `Add`, `Sub`
 // to make computation flexible
 type Resource struct {
@@ -46,6 +81,9 @@ type Resource struct {
 	Pods resource.Quantity
 	// EphemeralStorage requirement
 	EphemeralStorage resource.Quantity
+	// HugePages requirement keyed by hugepages-<size>, hugepages are pre-allocated
+	// on the nodes and accounted separately from Memory like kube-scheduler does
+	HugePages CustomResources
 	// Custom resource requirement
 	Custom CustomResources
 }
@@ -53,14 +91,15 @@ type Resource struct {
 // NewResource returns A resource struct
 func NewResource() *Resource {
 	return &Resource{
-		Custom: CustomResources{},
+		HugePages: CustomResources{},
+		Custom:    CustomResources{},
 	}
 }
 
 // Equal is for two resources comparision
 func (r *Resource) Equal(other *Resource) bool {
 	return r.CPU.Equal(other.CPU) && r.Memory.Equal(other.Memory) && r.Pods.Equal(other.Pods) && r.
-		EphemeralStorage.Equal(other.EphemeralStorage) && r.Custom.Equal(other.Custom)
+		EphemeralStorage.Equal(other.EphemeralStorage) && r.HugePages.Equal(other.HugePages) && r.Custom.Equal(other.Custom)
 }
 
 // Add adds resource to the current one
@@ -69,17 +108,8 @@ func (r *Resource) Add(nc *Resource) {
 	r.Memory.Add(nc.Memory)
 	r.Pods.Add(nc.Pods)
 	r.EphemeralStorage.Add(nc.EphemeralStorage)
-	if len(nc.Custom) == 0 {
-		return
-	}
-	for name, quota := range nc.Custom {
-		if r.Custom == nil {
-			r.Custom = CustomResources{}
-		}
-		old := r.Custom[name]
-		old.Add(quota)
-		r.Custom[name] = old
-	}
+	r.HugePages = r.HugePages.add(nc.HugePages)
+	r.Custom = r.Custom.add(nc.Custom)
 }
 
 // Sub subs resource from the current one
@@ -88,17 +118,23 @@ func (r *Resource) Sub(nc *Resource) {
 	r.Memory.Sub(nc.Memory)
 	r.Pods.Sub(nc.Pods)
 	r.EphemeralStorage.Sub(nc.EphemeralStorage)
-	if len(nc.Custom) == 0 {
-		return
-	}
-	for name, quota := range nc.Custom {
-		if r.Custom == nil {
-			r.Custom = CustomResources{}
+	r.HugePages = r.HugePages.sub(nc.HugePages)
+	r.Custom = r.Custom.sub(nc.Custom)
+}
+
+// SetMax sets each resource of the current one to the max of itself and nc
+func (r *Resource) SetMax(nc *Resource) {
+	setMax := func(q *resource.Quantity, other resource.Quantity) {
+		if other.Cmp(*q) > 0 {
+			*q = other
 		}
-		old := r.Custom[name]
-		old.Sub(quota)
-		r.Custom[name] = old
 	}
+	setMax(&r.CPU, nc.CPU)
+	setMax(&r.Memory, nc.Memory)
+	setMax(&r.Pods, nc.Pods)
+	setMax(&r.EphemeralStorage, nc.EphemeralStorage)
+	r.HugePages = r.HugePages.setMax(nc.HugePages)
+	r.Custom = r.Custom.setMax(nc.Custom)
 }
 
 // SetCapacityToNode set the resource the virtual-kubelet node
@@ -122,16 +158,36 @@ func (r *Resource) SetCapacityToNode(node *corev1.Node) {
 		corev1.ResourcePods:             Pods,
 		corev1.ResourceEphemeralStorage: empStorage,
 	}
+	for name, quota := range r.HugePages {
+		node.Status.Capacity[name] = quota
+	}
 	for name, quota := range r.Custom {
 		node.Status.Capacity[name] = quota
 	}
 	node.Status.Allocatable = node.Status.Capacity.DeepCopy()
-	klog.Infof("%v", node.Status.Capacity)
+}
+
+// List returns the resources as a ResourceList
+func (r *Resource) List() corev1.ResourceList {
+	list := corev1.ResourceList{
+		corev1.ResourceCPU:              r.CPU,
+		corev1.ResourceMemory:           r.Memory,
+		corev1.ResourcePods:             r.Pods,
+		corev1.ResourceEphemeralStorage: r.EphemeralStorage,
+	}
+	for name, quota := range r.HugePages {
+		list[name] = quota
+	}
+	for name, quota := range r.Custom {
+		list[name] = quota
+	}
+	return list
 }
 
 // ConvertResource converts ResourceList to Resource
 func ConvertResource(resources corev1.ResourceList) *Resource {
 	var cpu, mem, pods, empStorage resource.Quantity
+	hugePages := CustomResources{}
 	customResource := CustomResources{}
 	for resourceName, quota := range resources {
 		switch resourceName {
@@ -144,6 +200,10 @@ func ConvertResource(resources corev1.ResourceList) *Resource {
 		case corev1.ResourceEphemeralStorage:
 			empStorage = quota
 		default:
+			if strings.HasPrefix(string(resourceName), corev1.ResourceHugePagesPrefix) {
+				hugePages[resourceName] = quota
+				continue
+			}
 			customResource[resourceName] = quota
 		}
 	}
@@ -152,6 +212,7 @@ func ConvertResource(resources corev1.ResourceList) *Resource {
 		Memory:           mem,
 		Pods:             pods,
 		EphemeralStorage: empStorage,
+		HugePages:        hugePages,
 		Custom:           customResource,
 	}
 }
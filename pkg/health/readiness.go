@@ -0,0 +1,61 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Informers 记录各下游集群 informer 的同步状态，用于就绪探针区分启动卡住和启动较慢
+var Informers = NewReadiness()
+
+// Readiness 一组需要全部就绪的组件
+type Readiness struct {
+	lock   sync.RWMutex
+	synced map[string]bool
+}
+
+// NewReadiness returns an empty Readiness
+func NewReadiness() *Readiness {
+	return &Readiness{synced: map[string]bool{}}
+}
+
+// Register 添加一个未就绪的组件
+func (r *Readiness) Register(name string) {
+	r.Set(name, false)
+}
+
+// Set 更新组件的就绪状态
+func (r *Readiness) Set(name string, synced bool) {
+	r.lock.Lock()
+	r.synced[name] = synced
+	r.lock.Unlock()
+}
+
+// Ready 返回是否有组件注册且全部就绪，以及未就绪的组件
+func (r *Readiness) Ready() (bool, []string) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	var pending []string
+	for name, synced := range r.synced {
+		if !synced {
+			pending = append(pending, name)
+		}
+	}
+	sort.Strings(pending)
+	return len(r.synced) > 0 && len(pending) == 0, pending
+}
+
+// ServeHTTP 全部就绪时返回 200，否则返回 503，响应中包含每个组件的状态
+func (r *Readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ready, _ := r.Ready()
+	r.lock.RLock()
+	data, _ := json.Marshal(r.synced)
+	r.lock.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(data)
+}
@@ -0,0 +1,27 @@
+package health
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/logging"
+)
+
+// Serve 在 addr 上暴露 Informers 的就绪探针 /readyz，直到 ctx 结束
+func Serve(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/readyz", Informers)
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	logger := logging.G(ctx, logging.Telemetry).WithField("addr", addr)
+	logger.Info("Serve readiness")
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.WithError(err).Error("Serve readiness failed")
+	}
+}
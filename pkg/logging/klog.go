@@ -0,0 +1,56 @@
+package logging
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+)
+
+// klogLogger 将 client-go 通过 klog 输出的日志转到 log.L，klog 已经按 -v 过滤过详细日志
+type klogLogger struct {
+	logger log.Logger
+}
+
+var _ logr.Logger = klogLogger{}
+
+func (k klogLogger) Enabled() bool {
+	return true
+}
+
+// Info klog 设置 logr 后不再输出自己的头部，warning 也通过 Info 传入，因此无法区分
+func (k klogLogger) Info(msg string, keysAndValues ...interface{}) {
+	k.withValues(keysAndValues).Info(strings.TrimSuffix(msg, "\n"))
+}
+
+func (k klogLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	logger := k.withValues(keysAndValues)
+	if err != nil {
+		logger = logger.WithError(err)
+	}
+	logger.Error(strings.TrimSuffix(msg, "\n"))
+}
+
+func (k klogLogger) V(int) logr.Logger {
+	return k
+}
+
+func (k klogLogger) WithValues(keysAndValues ...interface{}) logr.Logger {
+	return klogLogger{logger: k.withValues(keysAndValues)}
+}
+
+func (k klogLogger) WithName(name string) logr.Logger {
+	return klogLogger{logger: k.logger.WithField("logger", name)}
+}
+
+func (k klogLogger) withValues(keysAndValues []interface{}) log.Logger {
+	if len(keysAndValues) == 0 {
+		return k.logger
+	}
+	fields := log.Fields{}
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fields[fmt.Sprint(keysAndValues[i])] = keysAndValues[i+1]
+	}
+	return k.logger.WithFields(fields)
+}
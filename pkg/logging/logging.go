@@ -0,0 +1,208 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	logruslogger "github.com/virtual-kubelet/virtual-kubelet/log/logrus"
+	"k8s.io/klog/v2"
+)
+
+// 日志的子系统，每个子系统可以单独设置日志级别
+const (
+	// Provider pod 的转发以及下游集群的启动
+	Provider = "provider"
+	// Capacity 虚拟节点的容量、label 和 condition
+	Capacity = "capacity"
+	// Failover 下游集群的健康检查和故障转移
+	Failover = "failover"
+	// Descheduler 重调度
+	Descheduler = "descheduler"
+	// Quota namespace 配额
+	Quota = "quota"
+	// Config 配置热加载以及凭据轮换
+	Config = "config"
+	// Events 下游事件的转发
+	Events = "events"
+	// Zone 按 zone 拆分的虚拟节点
+	Zone = "zone"
+	// Telemetry 指标和 trace 的上报
+	Telemetry = "telemetry"
+	// ClientGo client-go 通过 klog 输出的日志
+	ClientGo = "client-go"
+)
+
+// 日志中的字段名
+const (
+	FieldSubsystem = "subsystem"
+	FieldNode      = "node"
+	FieldCluster   = "cluster"
+	FieldNamespace = "namespace"
+	FieldPod       = "pod"
+)
+
+var subsystems = []string{Provider, Capacity, Failover, Descheduler, Quota, Config, Events, Zone, Telemetry, ClientGo}
+
+// Options 日志的输出格式以及各子系统的日志级别，默认级别由 node-cli 的 --log-level 设置
+type Options struct {
+	// Format 输出格式，text 或 json
+	Format string
+	// Levels 子系统到日志级别的映射，未列出的子系统使用默认级别
+	Levels map[string]string
+}
+
+// FlagSet returns the flags of the logging options
+func (o *Options) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet("logging", pflag.ContinueOnError)
+	flags.StringVar(&o.Format, "log-format", o.Format, `log output format, "text" or "json"`)
+	flags.StringToStringVar(&o.Levels, "log-subsystem-level", o.Levels, fmt.Sprintf(
+		"log level of a subsystem in the form subsystem=level, overriding --log-level, subsystems: %s",
+		strings.Join(subsystems, ", ")))
+	return flags
+}
+
+var (
+	// defaultLevel 未单独设置级别的子系统以及 virtual-kubelet 自身的日志级别
+	defaultLevel = logrus.InfoLevel
+	// levels 各子系统的日志级别，只在启动时由 Configure 设置
+	levels = map[string]logrus.Level{}
+)
+
+// Configure 设置 logger 的输出格式，并将 log.L 和 klog 替换为按子系统过滤级别的 logger，
+// 需要在 node-cli 设置 logger 的级别之后调用
+func Configure(o *Options, logger *logrus.Logger) error {
+	switch o.Format {
+	case "", "text":
+	case "json":
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q", o.Format)
+	}
+
+	defaultLevel = logger.GetLevel()
+	most := defaultLevel
+	for subsystem, s := range o.Levels {
+		if !containsString(subsystems, subsystem) {
+			return fmt.Errorf("unknown log subsystem %q, subsystems: %s", subsystem, strings.Join(subsystems, ", "))
+		}
+		level, err := logrus.ParseLevel(s)
+		if err != nil {
+			return fmt.Errorf("log level of subsystem %s: %v", subsystem, err)
+		}
+		levels[subsystem] = level
+		if level > most {
+			most = level
+		}
+	}
+	// logrus 按最详细的级别输出，再由 levelLogger 按子系统过滤
+	logger.SetLevel(most)
+	log.L = &levelLogger{Logger: logruslogger.FromLogrus(logrus.NewEntry(logger)), level: defaultLevel}
+	klog.SetLogger(klogLogger{logger: G(context.Background(), ClientGo)})
+	return nil
+}
+
+// G 返回 subsystem 子系统的 logger，保留 ctx 中 virtual-kubelet 和 trace 附加的字段
+func G(ctx context.Context, subsystem string) log.Logger {
+	return log.G(ctx).WithField(FieldSubsystem, subsystem)
+}
+
+func levelOf(subsystem interface{}) logrus.Level {
+	if s, ok := subsystem.(string); ok {
+		if level, ok := levels[s]; ok {
+			return level
+		}
+	}
+	return defaultLevel
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// levelLogger 按 level 过滤日志，添加 subsystem 字段时切换为该子系统的级别，
+// 因此经过 trace 等其他 logger 包装之后仍然按子系统过滤
+type levelLogger struct {
+	log.Logger
+	level logrus.Level
+}
+
+func (l *levelLogger) enabled(level logrus.Level) bool {
+	return l.level >= level
+}
+
+func (l *levelLogger) Debug(args ...interface{}) {
+	if l.enabled(logrus.DebugLevel) {
+		l.Logger.Debug(args...)
+	}
+}
+
+func (l *levelLogger) Debugf(format string, args ...interface{}) {
+	if l.enabled(logrus.DebugLevel) {
+		l.Logger.Debugf(format, args...)
+	}
+}
+
+func (l *levelLogger) Info(args ...interface{}) {
+	if l.enabled(logrus.InfoLevel) {
+		l.Logger.Info(args...)
+	}
+}
+
+func (l *levelLogger) Infof(format string, args ...interface{}) {
+	if l.enabled(logrus.InfoLevel) {
+		l.Logger.Infof(format, args...)
+	}
+}
+
+func (l *levelLogger) Warn(args ...interface{}) {
+	if l.enabled(logrus.WarnLevel) {
+		l.Logger.Warn(args...)
+	}
+}
+
+func (l *levelLogger) Warnf(format string, args ...interface{}) {
+	if l.enabled(logrus.WarnLevel) {
+		l.Logger.Warnf(format, args...)
+	}
+}
+
+func (l *levelLogger) Error(args ...interface{}) {
+	if l.enabled(logrus.ErrorLevel) {
+		l.Logger.Error(args...)
+	}
+}
+
+func (l *levelLogger) Errorf(format string, args ...interface{}) {
+	if l.enabled(logrus.ErrorLevel) {
+		l.Logger.Errorf(format, args...)
+	}
+}
+
+func (l *levelLogger) WithField(key string, value interface{}) log.Logger {
+	level := l.level
+	if key == FieldSubsystem {
+		level = levelOf(value)
+	}
+	return &levelLogger{Logger: l.Logger.WithField(key, value), level: level}
+}
+
+func (l *levelLogger) WithFields(fields log.Fields) log.Logger {
+	level := l.level
+	if subsystem, ok := fields[FieldSubsystem]; ok {
+		level = levelOf(subsystem)
+	}
+	return &levelLogger{Logger: l.Logger.WithFields(fields), level: level}
+}
+
+func (l *levelLogger) WithError(err error) log.Logger {
+	return &levelLogger{Logger: l.Logger.WithError(err), level: l.level}
+}
@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const namespace = "cas_vk"
+
+var (
+	// Registry provider 指标的注册表
+	Registry = prometheus.NewRegistry()
+
+	// CapacityDrift 最近一次全量重算时，增量维护的虚拟节点容量与下游实际容量的差值
+	CapacityDrift = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "capacity_drift",
+		Help:      "Difference between the incrementally tracked and the recomputed capacity of the virtual node at the last recomputation.",
+	}, []string{"node", "resource"})
+
+	// CapacityRecomputations 全量重算的次数，drifted 表示是否发现了偏差
+	CapacityRecomputations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "capacity_recomputations_total",
+		Help:      "Number of full capacity recomputations of the virtual node.",
+	}, []string{"node", "drifted"})
+
+	// PodOperationDuration CreatePod、DeletePod 等操作的耗时
+	PodOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "pod_operation_duration_seconds",
+		Help:      "Latency of pod operations forwarded to the client clusters.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	// PodOperationErrors 失败的 pod 操作，按原因区分
+	PodOperationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pod_operation_errors_total",
+		Help:      "Number of failed pod operations by reason.",
+	}, []string{"operation", "reason"})
+
+	// NodeStatusUpdates 通知 virtual-kubelet 的虚拟节点状态更新次数
+	NodeStatusUpdates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "node_status_updates_total",
+		Help:      "Number of virtual node status updates sent to virtual-kubelet.",
+	}, []string{"node"})
+
+	// ClientRequestDuration 访问下游 apiserver 的请求耗时
+	ClientRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "client_request_duration_seconds",
+		Help:      "Latency of requests to the apiserver of each client cluster.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"cluster", "verb", "code"})
+)
+
+func init() {
+	Registry.MustRegister(CapacityDrift, CapacityRecomputations, PodOperationDuration, PodOperationErrors,
+		NodeStatusUpdates, ClientRequestDuration)
+}
+
+// Quantity 将资源数量转换为指标取值
+func Quantity(q resource.Quantity) float64 {
+	return float64(q.MilliValue()) / 1000
+}
+
+// Serve 在 addr 上暴露 /metrics 以及 handlers 中的其他路径，直到 ctx 结束
+func Serve(ctx context.Context, addr string, handlers map[string]http.Handler) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+	for pattern, handler := range handlers {
+		mux.Handle(pattern, handler)
+	}
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	logger := logging.G(ctx, logging.Telemetry).WithField("addr", addr)
+	logger.Info("Serve provider metrics")
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.WithError(err).Error("Serve provider metrics failed")
+	}
+}
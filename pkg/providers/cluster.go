@@ -0,0 +1,367 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/common"
+	"github.com/practice/virtual-kubelet-practice/pkg/health"
+	"github.com/practice/virtual-kubelet-practice/pkg/logging"
+	"github.com/practice/virtual-kubelet-practice/pkg/util"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// cluster 一个下游集群，包括它的客户端、缓存和健康状态
+type cluster struct {
+	id          string
+	client      kubernetes.Interface
+	clientCache clientCache
+	// transport 凭据被轮换后自动使用新凭据
+	transport *rotatingTransport
+
+	informerFactory    informers.SharedInformerFactory
+	podInformerFactory informers.SharedInformerFactory
+	// hostPodInformerFactory 下游集群自己的 pod，即不是由 virtual kubelet 转发的 pod，用于从节点容量中扣除
+	hostPodInformerFactory informers.SharedInformerFactory
+	// readiness 记录 informer 的同步状态
+	readiness *health.Readiness
+
+	lock sync.Mutex
+	// healthy 集群是否可用，不可用的集群不参与调度和容量计算
+	healthy bool
+	// failures 连续探测失败次数
+	failures int
+	// unhealthySince 集群变为不可用的时间
+	unhealthySince time.Time
+	// failedOver 集群上的 pod 是否已迁移到其他集群
+	failedOver bool
+}
+
+// parseClusterConfig 解析 id=path 格式的集群配置，没有 id 时使用 kubeconfig 的当前 context 名
+func parseClusterConfig(s string) (string, clusterCredentials) {
+	id, path := clusterID(s)
+	return id, clusterCredentials{kubeconfig: path}
+}
+
+func clusterID(s string) (string, string) {
+	if i := strings.Index(s, "="); i > 0 {
+		return s[:i], s[i+1:]
+	}
+	if raw, err := clientcmd.LoadFromFile(s); err == nil && raw.CurrentContext != "" {
+		return raw.CurrentContext, s
+	}
+	return strings.TrimSuffix(filepath.Base(s), filepath.Ext(s)), s
+}
+
+// defaultCluster 没有配置 ClusterConfigs 时唯一的下游集群，依次使用 ClientConfig、ClientTokenFile 和 in-cluster 配置
+func defaultCluster(options *common.ProviderConfig) (string, clusterCredentials) {
+	credentials := clusterCredentials{
+		kubeconfig: options.ClientConfig,
+		server:     options.ClientServer,
+		tokenFile:  options.ClientTokenFile,
+		caFile:     options.ClientCAFile,
+	}
+	if options.ClientConfig != "" {
+		id, _ := clusterID(options.ClientConfig)
+		return id, credentials
+	}
+	return "default", credentials
+}
+
+// newCluster 根据凭据创建下游集群，informer 需要调用 start 启动
+func newCluster(id string, credentials clusterCredentials) (*cluster, error) {
+	config, transport, err := newRotatingConfig(id, credentials)
+	if err != nil {
+		return nil, fmt.Errorf("build config of cluster %s from %v: %v", id, credentials, err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("build clientset of cluster %s: %v", id, err)
+	}
+	cl := newClusterWithClient(id, clientset, health.Informers)
+	cl.transport = transport
+	return cl, nil
+}
+
+// nodeNameIndex 按 spec.nodeName 索引下游集群自己的 pod
+const nodeNameIndex = "nodeName"
+
+// newClusterWithClient 创建使用 client 的下游集群并在 readiness 中登记它的 informer
+func newClusterWithClient(id string, client kubernetes.Interface, readiness *health.Readiness) *cluster {
+	informerFactory := informers.NewSharedInformerFactory(client, 0)
+	// 只关心由 virtual kubelet 转发到下游的 pod
+	podInformerFactory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = util.VirtualPodLabel + "=true"
+		}))
+	// 下游集群自己的未结束的 pod，它们占用的资源不能提供给虚拟节点
+	hostPodInformerFactory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = util.VirtualPodLabel + "!=true"
+			options.FieldSelector = activePodSelector.String()
+		}))
+	hostPodInformer := hostPodInformerFactory.Core().V1().Pods().Informer()
+	hostPodInformer.AddIndexers(cache.Indexers{nodeNameIndex: func(obj interface{}) ([]string, error) {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok || pod.Spec.NodeName == "" {
+			return nil, nil
+		}
+		return []string{pod.Spec.NodeName}, nil
+	}})
+
+	cl := &cluster{
+		id:     id,
+		client: client,
+		clientCache: clientCache{
+			nodeLister:     informerFactory.Core().V1().Nodes().Lister(),
+			podLister:      podInformerFactory.Core().V1().Pods().Lister(),
+			hostPodIndexer: hostPodInformer.GetIndexer(),
+		},
+		informerFactory:        informerFactory,
+		podInformerFactory:     podInformerFactory,
+		hostPodInformerFactory: hostPodInformerFactory,
+		readiness:              readiness,
+		healthy:                true,
+	}
+	cl.registerInformers()
+	return cl
+}
+
+// informerFactories 返回集群的 informer factory，key 为其 informer 在就绪探针中名称的前缀，用于区分同类型的 informer
+func (cl *cluster) informerFactories() map[string]informers.SharedInformerFactory {
+	return map[string]informers.SharedInformerFactory{
+		"":        cl.informerFactory,
+		"Virtual": cl.podInformerFactory,
+		"Host":    cl.hostPodInformerFactory,
+	}
+}
+
+// registerInformers 在就绪探针中登记需要等待同步的 informer
+func (cl *cluster) registerInformers() {
+	cl.readiness.Register(cl.informerName("", reflect.TypeOf(&corev1.Node{})))
+	cl.readiness.Register(cl.informerName("Virtual", reflect.TypeOf(&corev1.Pod{})))
+	cl.readiness.Register(cl.informerName("Host", reflect.TypeOf(&corev1.Pod{})))
+}
+
+// startInformers 启动集群的所有 informer，直到 stopCh 关闭
+func (cl *cluster) startInformers(stopCh <-chan struct{}) {
+	for _, factory := range cl.informerFactories() {
+		factory.Start(stopCh)
+	}
+}
+
+// logger 返回该集群 subsystem 子系统的 logger，集群由所有虚拟节点共享，因此不带 node 字段
+func (cl *cluster) logger(ctx context.Context, subsystem string) log.Logger {
+	return logging.G(ctx, subsystem).WithField(logging.FieldCluster, cl.id)
+}
+
+// start 启动 informer 并等待缓存同步，每次等待 backoff 的一个间隔，重试次数用完后返回错误
+func (cl *cluster) start(ctx context.Context, backoff wait.Backoff) error {
+	cl.startInformers(ctx.Done())
+	go cl.transport.watch(ctx)
+	for {
+		timeout := backoff.Step()
+		pending := cl.waitForCacheSync(ctx, timeout)
+		if len(pending) == 0 {
+			cl.logger(ctx, logging.Provider).Info("Informers synced")
+			return nil
+		}
+		if backoff.Steps == 0 || ctx.Err() != nil {
+			return fmt.Errorf("informers %v of cluster %s not synced", pending, cl.id)
+		}
+		cl.logger(ctx, logging.Provider).WithField("informers", pending).Warnf("Informers not synced after %v, keep waiting", timeout)
+	}
+}
+
+// waitForCacheSync 等待 informer 同步最多 timeout，更新就绪状态并返回未同步的 informer
+func (cl *cluster) waitForCacheSync(ctx context.Context, timeout time.Duration) []string {
+	syncCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var pending []string
+	for prefix, factory := range cl.informerFactories() {
+		for informerType, synced := range factory.WaitForCacheSync(syncCtx.Done()) {
+			name := cl.informerName(prefix, informerType)
+			cl.readiness.Set(name, synced)
+			if !synced {
+				pending = append(pending, name)
+			}
+		}
+	}
+	sort.Strings(pending)
+	return pending
+}
+
+// informerName 返回 informer 在就绪探针中的名称，例如 cluster/Node、cluster/HostPod，
+// WaitForCacheSync 返回的是 *v1.Node 这样的指针类型，需要取其元素类型的名称
+func (cl *cluster) informerName(prefix string, informerType reflect.Type) string {
+	if informerType.Kind() == reflect.Ptr {
+		informerType = informerType.Elem()
+	}
+	return cl.id + "/" + prefix + informerType.Name()
+}
+
+func (cl *cluster) isHealthy() bool {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	return cl.healthy
+}
+
+// recordProbe 记录一次健康探测的结果，返回健康状态是否发生变化
+func (cl *cluster) recordProbe(err error, threshold int) bool {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	if err == nil {
+		cl.failures = 0
+		if cl.healthy {
+			return false
+		}
+		cl.healthy = true
+		return true
+	}
+	cl.failures++
+	if !cl.healthy || cl.failures < threshold {
+		return false
+	}
+	cl.healthy = false
+	cl.unhealthySince = time.Now()
+	return true
+}
+
+// shouldFailover 集群不可用超过 timeout 且还未迁移时返回 true
+func (cl *cluster) shouldFailover(timeout time.Duration) bool {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	return timeout > 0 && !cl.healthy && !cl.failedOver && time.Since(cl.unhealthySince) > timeout
+}
+
+func (cl *cluster) setFailedOver(failedOver bool) {
+	cl.lock.Lock()
+	cl.failedOver = failedOver
+	cl.lock.Unlock()
+}
+
+// probe 探测下游 apiserver 是否可用
+func (cl *cluster) probe(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return cl.client.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Error()
+}
+
+// schedulableNodes 返回集群中可调度（见 nodeSchedulable）且通过 filter 的节点，这些节点为虚拟节点提供容量
+func (cl *cluster) schedulableNodes(filter func(*corev1.Node) bool) []*corev1.Node {
+	nodes, err := cl.clientCache.nodeLister.List(labels.Everything())
+	if err != nil {
+		return nil
+	}
+	var schedulable []*corev1.Node
+	for _, n := range nodes {
+		if !nodeSchedulable(n) {
+			cl.logger(context.Background(), logging.Capacity).WithField("clientNode", n.Name).Debug("Node not schedulable")
+			continue
+		}
+		if filter != nil && !filter(n) {
+			continue
+		}
+		schedulable = append(schedulable, n)
+	}
+	return schedulable
+}
+
+// capacity 汇总集群中可调度、Ready 且通过 filter 的节点的可分配资源，减去这些节点上已有 pod 的请求
+func (cl *cluster) capacity(filter func(*corev1.Node) bool) *common.Resource {
+	nodeResource := common.NewResource()
+	nodes := cl.schedulableNodes(filter)
+	for _, n := range nodes {
+		nc := common.ConvertResource(n.Status.Allocatable)
+		nodeResource.Add(nc)
+	}
+	nodeResource.Sub(cl.getResourceFromPods(nodes))
+	return nodeResource
+}
+
+// nodeCapacity 返回节点的可分配资源减去节点上已有 pod 的请求
+func (cl *cluster) nodeCapacity(node *corev1.Node) *common.Resource {
+	nodeResource := common.ConvertResource(node.Status.Allocatable)
+	nodeResource.Sub(cl.getResourceFromPodsByNodeName(node.Name))
+	return nodeResource
+}
+
+// activePodSelector 选择还占用节点资源的 pod
+var activePodSelector = fields.AndSelectors(
+	fields.OneTermNotEqualSelector("status.phase", string(corev1.PodSucceeded)),
+	fields.OneTermNotEqualSelector("status.phase", string(corev1.PodFailed)),
+)
+
+// getResourceFromPods 汇总 nodes 上已有 pod 的请求。虚拟节点转发的 pod 已经由上游调度器从虚拟节点的容量中扣除，
+// 因此不计入。pod 的增减不会触发节点事件，由周期性的全量重算更新
+func (cl *cluster) getResourceFromPods(nodes []*corev1.Node) *common.Resource {
+	podResource := common.NewResource()
+	for _, n := range nodes {
+		podResource.Add(cl.getResourceFromPodsByNodeName(n.Name))
+	}
+	return podResource
+}
+
+// getResourceFromPodsByNodeName 从缓存中汇总节点 nodeName 上已有 pod 的请求，见 getResourceFromPods
+func (cl *cluster) getResourceFromPodsByNodeName(nodeName string) *common.Resource {
+	podResource := common.NewResource()
+	pods, err := cl.clientCache.hostPodIndexer.ByIndex(nodeNameIndex, nodeName)
+	if err != nil {
+		return podResource
+	}
+	for _, obj := range pods {
+		if pod, ok := obj.(*corev1.Pod); ok {
+			addPodRequest(podResource, pod)
+		}
+	}
+	return podResource
+}
+
+// addPodRequest 将 pod 的请求和占用的一个 pod 数量加到 podResource 上，跳过虚拟节点转发的和已结束的 pod
+func addPodRequest(podResource *common.Resource, pod *corev1.Pod) {
+	if util.IsVirtualPod(pod) || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return
+	}
+	res := util.GetRequestFromPod(pod)
+	res.Pods = resource.MustParse("1")
+	podResource.Add(res)
+}
+
+// podCount 返回转发到该集群的 pod 数量
+func (cl *cluster) podCount() int {
+	pods, err := cl.clientCache.podLister.List(labels.Everything())
+	if err != nil {
+		return 0
+	}
+	return len(pods)
+}
+
+// hasResource 返回集群中是否有节点提供该资源
+func (cl *cluster) hasResource(name corev1.ResourceName) bool {
+	nodes, err := cl.clientCache.nodeLister.List(labels.Everything())
+	if err != nil {
+		return false
+	}
+	for _, n := range nodes {
+		if _, ok := n.Status.Capacity[name]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/common"
+	"github.com/practice/virtual-kubelet-practice/pkg/health"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newTestCluster 返回以 fake clientset 为下游的集群，informer 已创建但未启动
+func newTestCluster(id string, objects ...runtime.Object) *cluster {
+	return newClusterWithClient(id, fake.NewSimpleClientset(objects...), health.NewReadiness())
+}
+
+// startInformers 启动集群的 informer 并等待同步，测试结束时停止
+func startInformers(t *testing.T, cl *cluster) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	cl.startInformers(ctx.Done())
+	if pending := cl.waitForCacheSync(ctx, 10*time.Second); len(pending) != 0 {
+		t.Fatalf("informers %v not synced", pending)
+	}
+}
+
+func readyzStatus(r *health.Readiness) int {
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	return rec.Code
+}
+
+func TestWaitForCacheSyncMarksReady(t *testing.T) {
+	cl := newTestCluster("test")
+	if code := readyzStatus(cl.readiness); code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz before sync = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cl.startInformers(ctx.Done())
+	if pending := cl.waitForCacheSync(ctx, 10*time.Second); len(pending) != 0 {
+		t.Fatalf("informers %v not synced", pending)
+	}
+
+	if ready, pending := cl.readiness.Ready(); !ready {
+		t.Fatalf("not ready after sync, pending %v", pending)
+	}
+	if code := readyzStatus(cl.readiness); code != http.StatusOK {
+		t.Fatalf("readyz after sync = %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestClusterCapacitySubtractsPodRequests(t *testing.T) {
+	storage := func(node *corev1.Node) {
+		node.Status.Capacity[corev1.ResourceEphemeralStorage] = resource.MustParse("100Gi")
+		node.Status.Allocatable[corev1.ResourceEphemeralStorage] = resource.MustParse("90Gi")
+		node.Status.Allocatable[corev1.ResourcePods] = resource.MustParse("110")
+	}
+	withStorage := testPod("host", "n1", "1", false)
+	withStorage.Spec.Containers[0].Resources.Requests[corev1.ResourceEphemeralStorage] = resource.MustParse("10Gi")
+	finished := testPod("finished", "n1", "1", false)
+	finished.Status.Phase = corev1.PodSucceeded
+	cl := newTestCluster("test",
+		testNode("n1", "4", storage),
+		testNode("n2", "4", storage, cordoned),
+		withStorage,
+		finished,
+		testPod("forwarded", "n1", "1", true),
+		testPod("cordoned", "n2", "1", false),
+	)
+	startInformers(t, cl)
+
+	got := cl.capacity(nil)
+	want := common.NewResource()
+	want.CPU = resource.MustParse("3")
+	want.EphemeralStorage = resource.MustParse("80Gi")
+	want.Pods = resource.MustParse("109")
+	if !got.Equal(want) {
+		t.Fatalf("capacity = %s, want %s", describeResource(got), describeResource(want))
+	}
+}
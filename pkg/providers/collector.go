@@ -0,0 +1,164 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+var (
+	// errNoCluster 没有可用的下游集群
+	errNoCluster = errors.New("no reachable client cluster")
+	// errQuotaExceeded namespace 超出配额
+	errQuotaExceeded = errors.New("exceeded quota")
+)
+
+var (
+	advertisedCapacityDesc = prometheus.NewDesc("cas_vk_node_capacity",
+		"Capacity advertised by the virtual node.", []string{"node", "resource"}, nil)
+	downstreamCapacityDesc = prometheus.NewDesc("cas_vk_client_capacity",
+		"Capacity of the downstream nodes contributing to the virtual node.", []string{"node", "cluster", "resource"}, nil)
+	contributingNodesDesc = prometheus.NewDesc("cas_vk_contributing_nodes",
+		"Number of downstream nodes contributing capacity to the virtual node.", []string{"node", "cluster"}, nil)
+	forwardedPodsDesc = prometheus.NewDesc("cas_vk_forwarded_pods",
+		"Number of pods forwarded to the client clusters by phase.", []string{"node", "cluster", "phase"}, nil)
+	clusterHealthyDesc = prometheus.NewDesc("cas_vk_client_cluster_healthy",
+		"Whether the client cluster is reachable.", []string{"cluster"}, nil)
+)
+
+// collector 在抓取时根据缓存计算容量、节点和 pod 数量，避免与增量维护的状态不一致。
+// 进程中的所有 provider 共用一个 collector，重复注册同样的指标描述会失败
+type collector struct {
+	lock      sync.Mutex
+	providers []*CasProvider
+}
+
+// providerCollector 导出 NewCasProvider 创建的所有 provider 的指标
+var providerCollector = &collector{}
+
+func init() {
+	metrics.Registry.MustRegister(providerCollector)
+}
+
+// add 导出 provider 的指标，直到 ctx 结束
+func (col *collector) add(ctx context.Context, p *CasProvider) {
+	col.lock.Lock()
+	col.providers = append(col.providers, p)
+	col.lock.Unlock()
+	go func() {
+		<-ctx.Done()
+		col.lock.Lock()
+		defer col.lock.Unlock()
+		for i, provider := range col.providers {
+			if provider == p {
+				col.providers = append(col.providers[:i], col.providers[i+1:]...)
+				return
+			}
+		}
+	}()
+}
+
+func (col *collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{advertisedCapacityDesc, downstreamCapacityDesc, contributingNodesDesc,
+		forwardedPodsDesc, clusterHealthyDesc} {
+		ch <- desc
+	}
+}
+
+func (col *collector) Collect(ch chan<- prometheus.Metric) {
+	col.lock.Lock()
+	providers := append([]*CasProvider(nil), col.providers...)
+	col.lock.Unlock()
+	// 同一个集群只导出一次健康状态，重复的指标会导致抓取失败
+	seen := map[string]bool{}
+	for _, provider := range providers {
+		for _, cl := range provider.clusters {
+			if seen[cl.id] {
+				continue
+			}
+			seen[cl.id] = true
+			healthy := 0.0
+			if cl.isHealthy() {
+				healthy = 1
+			}
+			ch <- prometheus.MustNewConstMetric(clusterHealthyDesc, prometheus.GaugeValue, healthy, cl.id)
+		}
+		provider.collectNodes(ch)
+	}
+}
+
+// collectNodes 导出主节点和各 zone 虚拟节点的指标
+func (c *CasProvider) collectNodes(ch chan<- prometheus.Metric) {
+	for _, p := range c.nodeProviders() {
+		if !p.isConfigured() {
+			continue
+		}
+		for name, quantity := range p.providerNode.DeepCopy().Status.Capacity {
+			ch <- prometheus.MustNewConstMetric(advertisedCapacityDesc, prometheus.GaugeValue,
+				metrics.Quantity(quantity), p.nodeName, string(name))
+		}
+		for _, cl := range p.clusters {
+			p.collectCluster(ch, cl)
+		}
+	}
+}
+
+func (c *CasProvider) collectCluster(ch chan<- prometheus.Metric, cl *cluster) {
+	ch <- prometheus.MustNewConstMetric(contributingNodesDesc, prometheus.GaugeValue,
+		float64(len(cl.schedulableNodes(c.nodeSelected))), c.nodeName, cl.id)
+	for name, quantity := range c.clusterCapacity(cl).List() {
+		ch <- prometheus.MustNewConstMetric(downstreamCapacityDesc, prometheus.GaugeValue,
+			metrics.Quantity(quantity), c.nodeName, cl.id, string(name))
+	}
+	pods, err := cl.clientCache.podLister.List(labels.Everything())
+	if err != nil {
+		return
+	}
+	phases := map[corev1.PodPhase]int{}
+	for _, pod := range pods {
+		if c.ownsPod(pod) {
+			phases[pod.Status.Phase]++
+		}
+	}
+	for phase, count := range phases {
+		ch <- prometheus.MustNewConstMetric(forwardedPodsDesc, prometheus.GaugeValue,
+			float64(count), c.nodeName, cl.id, string(phase))
+	}
+}
+
+// observePodOperation 记录 pod 操作的耗时以及失败原因
+func observePodOperation(operation string, start time.Time, err error) {
+	metrics.PodOperationDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.PodOperationErrors.WithLabelValues(operation, errorReason(err)).Inc()
+	}
+}
+
+// errorReason 返回错误的原因，用于指标的 label
+func errorReason(err error) string {
+	switch {
+	case errors.Is(err, errNoCluster):
+		return "NoReachableCluster"
+	case errors.Is(err, errQuotaExceeded):
+		return "QuotaExceeded"
+	case errdefs.IsNotFound(err):
+		return "NotFound"
+	case errdefs.IsInvalidInput(err):
+		return "InvalidInput"
+	}
+	return string(apierrors.ReasonForError(err))
+}
+
+// observeClientRequest 记录访问下游 apiserver 的请求耗时
+func observeClientRequest(cluster, verb string, code int, start time.Time) {
+	metrics.ClientRequestDuration.WithLabelValues(cluster, verb, strconv.Itoa(code)).Observe(time.Since(start).Seconds())
+}
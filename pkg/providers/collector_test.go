@@ -0,0 +1,52 @@
+package providers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCollectorExportsEveryProvider(t *testing.T) {
+	col := &collector{}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(col)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	shared := newTestCluster("shared")
+	for _, name := range []string{"vk-a", "vk-b"} {
+		p := newTestProvider(t, nil, shared, newTestCluster(name))
+		p.nodeName = name
+		p.providerNode.Node = &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		p.setConfigured()
+		col.add(ctx, p)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := map[string]bool{}
+	clusters := 0
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "node" {
+					nodes[label.GetValue()] = true
+				}
+			}
+			if family.GetName() == "cas_vk_client_cluster_healthy" {
+				clusters++
+			}
+		}
+	}
+	if !nodes["vk-a"] || !nodes["vk-b"] {
+		t.Errorf("exported nodes %v, want vk-a and vk-b", nodes)
+	}
+	if clusters != 3 {
+		t.Errorf("exported health of %d clusters, want 3", clusters)
+	}
+}
@@ -0,0 +1,84 @@
+package providers
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// conditionReasons 每种 condition 为 True 和 False 时的 reason
+var conditionReasons = map[corev1.NodeConditionType][2]string{
+	corev1.NodeReady:          {"KubeletReady", "NoSchedulableNodes"},
+	corev1.NodeMemoryPressure: {"KubeletHasInsufficientMemory", "KubeletHasSufficientMemory"},
+	corev1.NodeDiskPressure:   {"KubeletHasDiskPressure", "KubeletHasNoDiskPressure"},
+	corev1.NodePIDPressure:    {"KubeletHasInsufficientPID", "KubeletHasSufficientPID"},
+}
+
+// nodeConditions 根据可用集群中可调度且 Ready 的下游节点计算虚拟节点的 conditions，
+// 状态没有变化的 condition 沿用 previous 中的 LastTransitionTime
+func (c *CasProvider) nodeConditions(previous []corev1.NodeCondition) []corev1.NodeCondition {
+	total := 0
+	pressure := map[corev1.NodeConditionType]int{}
+	for _, n := range c.conditionNodes() {
+		total++
+		for _, condition := range n.Status.Conditions {
+			if condition.Status == corev1.ConditionTrue {
+				pressure[condition.Type]++
+			}
+		}
+	}
+
+	readyMessage := fmt.Sprintf("%d schedulable ready nodes in client clusters", total)
+	conditions := []corev1.NodeCondition{
+		newNodeCondition(corev1.NodeReady, total > 0, readyMessage),
+	}
+	for _, t := range []corev1.NodeConditionType{corev1.NodeMemoryPressure, corev1.NodeDiskPressure, corev1.NodePIDPressure} {
+		under := total > 0 && float64(pressure[t]) >= c.options().NodePressureThreshold*float64(total)
+		message := fmt.Sprintf("%d of %d nodes in client clusters report %s", pressure[t], total, t)
+		conditions = append(conditions, newNodeCondition(t, under, message))
+	}
+	return mergeNodeConditions(previous, conditions)
+}
+
+func newNodeCondition(t corev1.NodeConditionType, status bool, message string) corev1.NodeCondition {
+	now := metav1.Now()
+	condition := corev1.NodeCondition{
+		Type:               t,
+		Status:             corev1.ConditionFalse,
+		LastHeartbeatTime:  now,
+		LastTransitionTime: now,
+		Reason:             conditionReasons[t][1],
+		Message:            message,
+	}
+	if status {
+		condition.Status = corev1.ConditionTrue
+		condition.Reason = conditionReasons[t][0]
+	}
+	return condition
+}
+
+// mergeNodeConditions 状态没有变化时保留原有的时间，只有真正发生状态转换时才更新 LastTransitionTime
+func mergeNodeConditions(previous, current []corev1.NodeCondition) []corev1.NodeCondition {
+	for i := range current {
+		for _, old := range previous {
+			if old.Type != current[i].Type || old.Status != current[i].Status {
+				continue
+			}
+			current[i].LastTransitionTime = old.LastTransitionTime
+			current[i].LastHeartbeatTime = old.LastHeartbeatTime
+		}
+	}
+	return current
+}
+
+// refreshNodeStatus 根据下游节点重新计算虚拟节点的 conditions、架构和聚合的 label
+func (c *CasProvider) refreshNodeStatus() {
+	if c.providerNode.Node == nil {
+		return
+	}
+	previous := c.providerNode.DeepCopy().Status.Conditions
+	c.providerNode.SetConditions(c.nodeConditions(previous))
+	c.refreshNodeArch()
+	c.refreshNodeLabels()
+}
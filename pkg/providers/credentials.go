@@ -0,0 +1,176 @@
+package providers
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/logging"
+	"github.com/practice/virtual-kubelet-practice/pkg/tracing"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	octrace "go.opencensus.io/trace"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// credentialCheckInterval 检查下游凭据文件是否被轮换的周期
+const credentialCheckInterval = 30 * time.Second
+
+// clusterCredentials 访问下游集群的凭据，按 kubeconfig、token 文件、in-cluster 的顺序选择
+type clusterCredentials struct {
+	// kubeconfig 下游集群的 kubeconfig，支持 exec 等认证插件
+	kubeconfig string
+	// server 使用 tokenFile 时下游 apiserver 的地址
+	server string
+	// tokenFile bearer token 文件，client-go 会定期重新读取
+	tokenFile string
+	// caFile 使用 tokenFile 时校验下游 apiserver 的 CA 证书
+	caFile string
+}
+
+func (cr clusterCredentials) String() string {
+	switch {
+	case cr.kubeconfig != "":
+		return "kubeconfig " + cr.kubeconfig
+	case cr.tokenFile != "":
+		return fmt.Sprintf("token file %s for %s", cr.tokenFile, cr.server)
+	default:
+		return "in-cluster config"
+	}
+}
+
+// restConfig 根据凭据创建下游集群的客户端配置
+func (cr clusterCredentials) restConfig() (*rest.Config, error) {
+	switch {
+	case cr.kubeconfig != "":
+		return clientcmd.BuildConfigFromFlags("", cr.kubeconfig)
+	case cr.tokenFile != "":
+		return &rest.Config{
+			Host:            cr.server,
+			BearerTokenFile: cr.tokenFile,
+			TLSClientConfig: rest.TLSClientConfig{CAFile: cr.caFile},
+		}, nil
+	default:
+		return rest.InClusterConfig()
+	}
+}
+
+// fingerprint 返回需要在变化时重建连接的文件内容摘要。client-go 会自行重新读取
+// token 文件和证书文件，但 kubeconfig 中内嵌的凭据和 CA 文件变化需要重建 transport
+func (cr clusterCredentials) fingerprint() string {
+	hash := sha256.New()
+	for _, file := range []string{cr.kubeconfig, cr.caFile} {
+		if file == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		hash.Write(data)
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+// rotatingTransport 在下游凭据被轮换后用新的凭据重建 transport，已经建立的客户端和 informer 无需重建
+type rotatingTransport struct {
+	// id 集群 id，用于记录请求耗时
+	id          string
+	credentials clusterCredentials
+
+	lock        sync.RWMutex
+	transport   http.RoundTripper
+	fingerprint string
+}
+
+// newRotatingConfig 返回使用 rotatingTransport 的客户端配置，apiserver 地址在轮换时不会改变
+func newRotatingConfig(id string, credentials clusterCredentials) (*rest.Config, *rotatingTransport, error) {
+	config, err := credentials.restConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	t := &rotatingTransport{id: id, credentials: credentials}
+	if err := t.rebuild(config); err != nil {
+		return nil, nil, err
+	}
+	return &rest.Config{
+		Host:      config.Host,
+		APIPath:   config.APIPath,
+		Transport: t,
+		QPS:       config.QPS,
+		Burst:     config.Burst,
+		Timeout:   config.Timeout,
+	}, t, nil
+}
+
+func (t *rotatingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.lock.RLock()
+	transport := t.transport
+	t.lock.RUnlock()
+	// 只为 provider 操作中发出的请求创建 span，informer 的 list/watch 不追踪
+	var span *octrace.Span
+	if tracing.InSpan(req.Context()) {
+		var ctx context.Context
+		ctx, span = tracing.StartClientSpan(req.Context(), "client."+req.Method,
+			octrace.StringAttribute(tracing.AttrCluster, t.id),
+			octrace.StringAttribute("path", req.URL.Path))
+		req = req.WithContext(ctx)
+	}
+	start := time.Now()
+	resp, err := transport.RoundTrip(req)
+	code := 0
+	if resp != nil {
+		code = resp.StatusCode
+	}
+	observeClientRequest(t.id, req.Method, code, start)
+	if span != nil {
+		spanErr := err
+		if err == nil && code >= http.StatusBadRequest {
+			spanErr = fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+		}
+		tracing.EndClientSpan(span, code, spanErr)
+	}
+	return resp, err
+}
+
+func (t *rotatingTransport) rebuild(config *rest.Config) error {
+	fingerprint := t.credentials.fingerprint()
+	transport, err := rest.TransportFor(config)
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	t.transport, t.fingerprint = transport, fingerprint
+	t.lock.Unlock()
+	return nil
+}
+
+// watch 周期性检查凭据文件，变化时重建 transport，直到 ctx 结束
+func (t *rotatingTransport) watch(ctx context.Context) {
+	logger := logging.G(ctx, logging.Config).WithFields(log.Fields{
+		logging.FieldCluster: t.id,
+		"credentials":        t.credentials.String(),
+	})
+	wait.Until(func() {
+		t.lock.RLock()
+		fingerprint := t.fingerprint
+		t.lock.RUnlock()
+		if t.credentials.fingerprint() == fingerprint {
+			return
+		}
+		config, err := t.credentials.restConfig()
+		if err == nil {
+			err = t.rebuild(config)
+		}
+		if err != nil {
+			logger.WithError(err).Error("Reload rotated credentials failed")
+			return
+		}
+		logger.Info("Reload rotated credentials")
+	}, credentialCheckInterval, ctx.Done())
+}
@@ -0,0 +1,199 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/logging"
+	"github.com/practice/virtual-kubelet-practice/pkg/util"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// recreateInterval 等待旧 pod 删除后重新创建的重试间隔
+	recreateInterval = time.Second
+	// recreateTimeout 等待旧 pod 删除的超时时间
+	recreateTimeout = 30 * time.Second
+)
+
+// descheduler 检测转发到下游后长时间 Pending 或无法调度的 pod，
+// 将其删除并重新创建，让下游调度器把它放到其他节点上
+type descheduler struct {
+	provider *CasProvider
+	interval time.Duration
+	// gaveUp 记录已达到最大重调度次数的 pod，避免重复打印日志
+	gaveUp map[types.UID]bool
+}
+
+func newDescheduler(c *CasProvider) *descheduler {
+	return &descheduler{
+		provider: c,
+		interval: c.options().DescheduleInterval,
+		gaveUp:   map[types.UID]bool{},
+	}
+}
+
+// run 周期性检查下游 pod，直到 ctx 结束
+func (d *descheduler) run(ctx context.Context) {
+	options := d.provider.options()
+	d.provider.logger(ctx, logging.Descheduler).WithFields(log.Fields{
+		"interval":  d.interval.String(),
+		"threshold": options.DescheduleThreshold.String(),
+		"maxCount":  options.MaxDescheduleCount,
+	}).Info("Start descheduler")
+	wait.Until(func() {
+		d.deschedule(ctx)
+	}, d.interval, ctx.Done())
+}
+
+func (d *descheduler) deschedule(ctx context.Context) {
+	seen := map[types.UID]bool{}
+	for _, cl := range d.provider.clusters {
+		if !cl.isHealthy() {
+			continue
+		}
+		d.descheduleCluster(ctx, cl, seen)
+	}
+	for uid := range d.gaveUp {
+		if !seen[uid] {
+			delete(d.gaveUp, uid)
+		}
+	}
+}
+
+func (d *descheduler) descheduleCluster(ctx context.Context, cl *cluster, seen map[types.UID]bool) {
+	logger := cl.logger(ctx, logging.Descheduler)
+	pods, err := cl.clientCache.podLister.List(labels.Everything())
+	if err != nil {
+		logger.WithError(err).Error("List pods failed")
+		return
+	}
+	for _, pod := range pods {
+		seen[pod.UID] = true
+		if !d.isStuck(pod) {
+			continue
+		}
+		count := util.GetDescheduleCount(pod)
+		if count >= d.provider.options().MaxDescheduleCount {
+			if !d.gaveUp[pod.UID] {
+				withPod(logger, pod).Warnf("Pod has been rescheduled %d times, give up", count)
+				d.gaveUp[pod.UID] = true
+			}
+			continue
+		}
+		if err := d.reschedule(ctx, cl, pod, count+1); err != nil {
+			withPod(logger, pod).WithError(err).Error("Reschedule pod failed")
+		}
+	}
+}
+
+// isStuck 判断 pod 是否在下游 Pending 超过阈值
+func (d *descheduler) isStuck(pod *corev1.Pod) bool {
+	if pod.DeletionTimestamp != nil || pod.Status.Phase != corev1.PodPending {
+		return false
+	}
+	since := pod.CreationTimestamp.Time
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodScheduled && !condition.LastTransitionTime.IsZero() {
+			since = condition.LastTransitionTime.Time
+		}
+	}
+	return time.Since(since) > d.provider.options().DescheduleThreshold
+}
+
+// reschedule 删除下游 pod 并以新的重调度次数重新创建，
+// 优先放到其他可用集群，没有其他集群或在其他集群创建失败时放回原集群并避开原节点。
+// 下游 pod 与上游 pod 同名，因此只能先删除再创建，都创建失败时将上游 pod 标记为 Failed
+func (d *descheduler) reschedule(ctx context.Context, cl *cluster, pod *corev1.Pod, count int) error {
+	newPod := util.TrimPod(pod)
+	if newPod.Annotations == nil {
+		newPod.Annotations = map[string]string{}
+	}
+	newPod.Annotations[util.CreatedbyDescheduler] = "true"
+	newPod.Annotations[util.DescheduleCount] = strconv.Itoa(count)
+	// fallback 放回原集群时使用，避开原节点
+	fallback := newPod.DeepCopy()
+	if pod.Spec.NodeName != "" {
+		excludeNode(fallback, pod.Spec.NodeName)
+	}
+	target := d.provider.pickCluster(ctx, pod, cl.id)
+	if target == nil {
+		target, newPod = cl, fallback
+	}
+
+	logger := withPod(cl.logger(ctx, logging.Descheduler), pod)
+	logger.WithFields(log.Fields{
+		"clientNode":    pod.Spec.NodeName,
+		"unschedulable": util.IsPodUnschedulable(pod),
+		"count":         count,
+	}).Infof("Reschedule pod to cluster %s", target.id)
+	d.provider.markDescheduling(pod.UID)
+	err := cl.client.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{
+		GracePeriodSeconds: new(int64),
+		Preconditions:      metav1.NewUIDPreconditions(string(pod.UID)),
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		d.provider.descheduling.Delete(pod.UID)
+		return err
+	}
+	err = d.recreate(ctx, target, newPod)
+	if err != nil && target != cl {
+		logger.WithError(err).Warnf("Recreate pod in cluster %s failed, put it back", target.id)
+		err = d.recreate(ctx, cl, fallback)
+	}
+	if err != nil {
+		d.provider.descheduling.Delete(pod.UID)
+		d.provider.failPod(pod, reasonRescheduleFailed, fmt.Sprintf("could not recreate pod after deleting it: %v", err))
+		return err
+	}
+	return nil
+}
+
+// recreate 等待同名的旧 pod 删除后在集群中创建 pod
+func (d *descheduler) recreate(ctx context.Context, cl *cluster, pod *corev1.Pod) error {
+	return wait.PollImmediate(recreateInterval, recreateTimeout, func() (bool, error) {
+		err := d.provider.createPodInCluster(ctx, cl, pod.DeepCopy())
+		if errors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+}
+
+// excludeNode 为 pod 添加节点反亲和，避免再次调度到同一个节点
+func excludeNode(pod *corev1.Pod, nodeName string) {
+	addNodeRequirement(pod, corev1.NodeSelectorRequirement{
+		Key:      util.HostNameKey,
+		Operator: corev1.NodeSelectorOpNotIn,
+		Values:   []string{nodeName},
+	})
+}
+
+// addNodeRequirement 为 pod 的每个必须满足的 node selector term 添加 requirement
+func addNodeRequirement(pod *corev1.Pod, requirement corev1.NodeSelectorRequirement) {
+	if pod.Spec.Affinity == nil {
+		pod.Spec.Affinity = &corev1.Affinity{}
+	}
+	if pod.Spec.Affinity.NodeAffinity == nil {
+		pod.Spec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	nodeAffinity := pod.Spec.Affinity.NodeAffinity
+	if nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{}
+	}
+	selector := nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if len(selector.NodeSelectorTerms) == 0 {
+		selector.NodeSelectorTerms = []corev1.NodeSelectorTerm{{}}
+	}
+	for i := range selector.NodeSelectorTerms {
+		selector.NodeSelectorTerms[i].MatchExpressions = append(selector.NodeSelectorTerms[i].MatchExpressions, requirement)
+	}
+}
@@ -0,0 +1,76 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestRescheduleFailsUpstreamPodWhenRecreateFails(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "web",
+			UID:         "downstream-uid",
+			Labels:      map[string]string{util.VirtualPodLabel: "true"},
+			Annotations: map[string]string{util.UpstreamPodUID: "upstream-uid"},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:   "node-1",
+			Containers: []corev1.Container{{Name: "app", Image: "nginx"}},
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodPending,
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name:  "app",
+				State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"}},
+			}},
+		},
+	}
+	cl := newTestCluster("a", pod)
+	cl.client.(*fake.Clientset).PrependReactor("create", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("boom")
+	})
+	p := newTestProvider(t, nil, cl)
+	var notified []*corev1.Pod
+	p.NotifyPods(context.Background(), func(pod *corev1.Pod) { notified = append(notified, pod) })
+
+	d := newDescheduler(p)
+	err := d.reschedule(context.Background(), cl, pod, 1)
+	if err == nil {
+		t.Fatal("reschedule succeeded, want the create error")
+	}
+
+	if _, ok := p.descheduling.Load(pod.UID); ok {
+		t.Error("pod is still marked as descheduling, its deletion would never reach the upstream pod")
+	}
+	if len(notified) != 1 {
+		t.Fatalf("notified %d pods, want 1", len(notified))
+	}
+	failed := notified[0]
+	if failed.Status.Phase != corev1.PodFailed || failed.Status.Reason != reasonRescheduleFailed {
+		t.Errorf("notified pod phase %s reason %q, want %s %q",
+			failed.Status.Phase, failed.Status.Reason, corev1.PodFailed, reasonRescheduleFailed)
+	}
+	if state := failed.Status.ContainerStatuses[0].State; state.Terminated == nil {
+		t.Errorf("container state %+v, want terminated", state)
+	}
+	select {
+	case event := <-p.recorder.(*record.FakeRecorder).Events:
+		if !strings.Contains(event, reasonRescheduleFailed) {
+			t.Errorf("event %q, want reason %s", event, reasonRescheduleFailed)
+		}
+	case <-time.After(time.Second):
+		t.Error("no event recorded on the upstream pod")
+	}
+}
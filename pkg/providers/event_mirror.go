@@ -0,0 +1,124 @@
+package providers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/logging"
+	"github.com/practice/virtual-kubelet-practice/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+const (
+	// mirrorQPS 每秒最多转发到上游的下游事件数
+	mirrorQPS = 10
+	// mirrorBurst 短时间内最多转发到上游的下游事件数
+	mirrorBurst = 50
+)
+
+// eventMirror 将下游调度器、kubelet 针对转发 pod 产生的事件转发到上游 pod 上
+type eventMirror struct {
+	provider *CasProvider
+	// started 之前产生的事件不转发，避免重启后重复转发历史事件
+	started time.Time
+	limiter flowcontrol.RateLimiter
+
+	lock sync.Mutex
+	// counts 已转发的下游事件及其次数，下游事件被聚合时次数增加
+	counts map[types.UID]int32
+}
+
+func newEventMirror(c *CasProvider) *eventMirror {
+	return &eventMirror{
+		provider: c,
+		started:  time.Now(),
+		limiter:  flowcontrol.NewTokenBucketRateLimiter(mirrorQPS, mirrorBurst),
+		counts:   map[types.UID]int32{},
+	}
+}
+
+// run 监听每个下游集群中与 pod 相关的事件，直到 ctx 结束
+func (m *eventMirror) run(ctx context.Context) {
+	for _, cl := range m.provider.clusters {
+		cl := cl
+		factory := informers.NewSharedInformerFactoryWithOptions(cl.client, 0,
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.FieldSelector = fields.OneTermEqualSelector("involvedObject.kind", "Pod").String()
+			}))
+		factory.Core().V1().Events().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				if event, ok := obj.(*corev1.Event); ok {
+					m.mirror(cl, event)
+				}
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				if event, ok := newObj.(*corev1.Event); ok {
+					m.mirror(cl, event)
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				if event, ok := obj.(*corev1.Event); ok {
+					m.forget(event.UID)
+				}
+			},
+		})
+		factory.Start(ctx.Done())
+	}
+}
+
+// mirror 事件属于转发到该集群的 pod 时在上游 pod 上记录同样的事件
+func (m *eventMirror) mirror(cl *cluster, event *corev1.Event) {
+	if eventTime(event).Before(m.started) || !m.firstSeen(event) {
+		return
+	}
+	ref := event.InvolvedObject
+	pod, err := cl.clientCache.podLister.Pods(ref.Namespace).Get(ref.Name)
+	if err != nil || pod.UID != ref.UID || pod.Annotations[util.UpstreamPodUID] == "" {
+		return
+	}
+	if owner := m.provider.ownerOf(pod.Namespace, pod.Name); owner == nil || owner.id != cl.id {
+		return
+	}
+	if !m.limiter.TryAccept() {
+		withPod(cl.logger(context.Background(), logging.Events), pod).WithField("reason", event.Reason).
+			Debug("Drop event, rate limited")
+		return
+	}
+	m.provider.recorder.Eventf(m.provider.upstreamPodRef(pod), event.Type, event.Reason,
+		"%s (client cluster %s)", event.Message, cl.id)
+}
+
+// firstSeen 记录事件的次数，同一个事件的同一次数只转发一次
+func (m *eventMirror) firstSeen(event *corev1.Event) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if count, ok := m.counts[event.UID]; ok && count >= event.Count {
+		return false
+	}
+	m.counts[event.UID] = event.Count
+	return true
+}
+
+func (m *eventMirror) forget(uid types.UID) {
+	m.lock.Lock()
+	delete(m.counts, uid)
+	m.lock.Unlock()
+}
+
+// eventTime 返回事件最后一次发生的时间
+func eventTime(event *corev1.Event) time.Time {
+	switch {
+	case !event.LastTimestamp.IsZero():
+		return event.LastTimestamp.Time
+	case !event.EventTime.IsZero():
+		return event.EventTime.Time
+	}
+	return event.CreationTimestamp.Time
+}
@@ -0,0 +1,115 @@
+package providers
+
+import (
+	"context"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/common"
+	"github.com/practice/virtual-kubelet-practice/pkg/logging"
+	"github.com/practice/virtual-kubelet-practice/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Event reasons emitted by the provider
+const (
+	reasonCapacityChanged    = "CapacityChanged"
+	reasonClientNodeJoined   = "ClientNodeJoined"
+	reasonClientNodeLeft     = "ClientNodeLeft"
+	reasonClusterUnreachable = "ClientClusterUnreachable"
+	reasonClusterReachable   = "ClientClusterReachable"
+	reasonForwarded          = "Forwarded"
+	reasonQuotaExceeded      = "QuotaExceeded"
+	reasonForwardFailed      = "ForwardFailed"
+	reasonImagePullFailed    = "ClientImagePullFailed"
+	reasonRescheduleFailed   = "RescheduleFailed"
+)
+
+// nodeRef 虚拟节点的引用，与 kubelet 一样使用节点名作为 UID
+func (c *CasProvider) nodeRef() *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		Kind: "Node",
+		Name: c.nodeName,
+		UID:  types.UID(c.nodeName),
+	}
+}
+
+// upstreamPodRef 根据下游 pod 构造上游 pod 的引用，上游 UID 由 TrimPod 记录在注解中
+func (c *CasProvider) upstreamPodRef(pod *corev1.Pod) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		Kind:      "Pod",
+		Namespace: c.upstreamNamespace(pod.Namespace),
+		Name:      pod.Name,
+		UID:       types.UID(pod.Annotations[util.UpstreamPodUID]),
+	}
+}
+
+// nodeEvent 在虚拟节点上记录事件
+func (c *CasProvider) nodeEvent(eventType, reason, messageFmt string, args ...interface{}) {
+	c.recorder.Eventf(c.nodeRef(), eventType, reason, messageFmt, args...)
+}
+
+// pushNodeUpdate 虚拟节点与 before 相比发生变化时通知 virtual-kubelet，容量变化时记录事件
+func (c *CasProvider) pushNodeUpdate(before *corev1.Node) {
+	after := c.providerNode.DeepCopy()
+	if equality.Semantic.DeepEqual(before, after) {
+		return
+	}
+	if !equality.Semantic.DeepEqual(before.Status.Capacity, after.Status.Capacity) {
+		c.logger(context.Background(), logging.Capacity).
+			WithField("capacity", describeResource(common.ConvertResource(after.Status.Capacity))).
+			Debug("Capacity changed")
+		c.nodeEvent(corev1.EventTypeNormal, reasonCapacityChanged, "Capacity changed to %s",
+			describeResource(common.ConvertResource(after.Status.Capacity)))
+	}
+	c.updatedNode.Notify(after)
+}
+
+// recordClientNodeChange 下游节点开始或停止为虚拟节点提供容量时记录事件
+func (c *CasProvider) recordClientNodeChange(cl *cluster, node *corev1.Node, joined bool) {
+	if joined {
+		c.nodeEvent(corev1.EventTypeNormal, reasonClientNodeJoined, "Node %s of client cluster %s contributes capacity",
+			node.Name, cl.id)
+	} else {
+		c.nodeEvent(corev1.EventTypeNormal, reasonClientNodeLeft, "Node %s of client cluster %s no longer contributes capacity",
+			node.Name, cl.id)
+	}
+}
+
+// recordImagePullFailures 下游容器拉取镜像失败时在上游 pod 上记录事件，同一失败原因只记录一次
+func (c *CasProvider) recordImagePullFailures(old, new *corev1.Pod) {
+	previous := map[string]string{}
+	for _, status := range append(old.Status.InitContainerStatuses, old.Status.ContainerStatuses...) {
+		if status.State.Waiting != nil {
+			previous[status.Name] = status.State.Waiting.Reason
+		}
+	}
+	for _, status := range append(new.Status.InitContainerStatuses, new.Status.ContainerStatuses...) {
+		waiting := status.State.Waiting
+		if waiting == nil || !isImagePullFailure(waiting.Reason) || previous[status.Name] == waiting.Reason {
+			continue
+		}
+		c.recorder.Eventf(c.upstreamPodRef(new), corev1.EventTypeWarning, reasonImagePullFailed,
+			"Container %s in client cluster: %s: %s", status.Name, waiting.Reason, waiting.Message)
+	}
+}
+
+func isImagePullFailure(reason string) bool {
+	switch reason {
+	case "ErrImagePull", "ImagePullBackOff", "InvalidImageName", "ErrImageNeverPull":
+		return true
+	}
+	return false
+}
+
+// recordCreateResult 在上游 pod 上记录转发结果
+func (c *CasProvider) recordCreateResult(pod *corev1.Pod, cl *cluster, err error) {
+	switch {
+	case err == nil:
+		c.recorder.Eventf(pod, corev1.EventTypeNormal, reasonForwarded, "Forwarded to client cluster %s", cl.id)
+	case errorReason(err) == "QuotaExceeded":
+		c.recorder.Event(pod, corev1.EventTypeWarning, reasonQuotaExceeded, err.Error())
+	default:
+		c.recorder.Event(pod, corev1.EventTypeWarning, reasonForwardFailed, err.Error())
+	}
+}
@@ -0,0 +1,218 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/logging"
+	"github.com/practice/virtual-kubelet-practice/pkg/tracing"
+	"github.com/practice/virtual-kubelet-practice/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// checkClusterHealth 周期性探测下游集群，直到 ctx 结束
+func (c *CasProvider) checkClusterHealth(ctx context.Context, cl *cluster) {
+	interval := c.options().ClusterHealthInterval
+	wait.Until(func() {
+		err := cl.probe(ctx, interval)
+		if err != nil {
+			cl.logger(ctx, logging.Failover).WithError(err).Warn("Probe cluster failed")
+		}
+		if cl.recordProbe(err, c.options().ClusterFailureThreshold) {
+			c.onClusterHealthChanged(ctx, cl, err == nil)
+		}
+		if cl.shouldFailover(c.options().ClusterFailoverTimeout) {
+			c.failoverCluster(ctx, cl)
+		}
+	}, interval, ctx.Done())
+}
+
+// onClusterHealthChanged 集群不可用时从虚拟节点中去掉它的容量，恢复时加回
+func (c *CasProvider) onClusterHealthChanged(ctx context.Context, cl *cluster, healthy bool) {
+	logger := cl.logger(ctx, logging.Failover)
+	if healthy {
+		logger.Info("Cluster is reachable again")
+		c.cleanupFailedOver(ctx, cl)
+	} else {
+		logger.Warn("Cluster is unreachable, stop placing pods on it")
+	}
+	for _, p := range c.nodeProviders() {
+		if healthy {
+			p.nodeEvent(corev1.EventTypeNormal, reasonClusterReachable, "Client cluster %s is reachable again", cl.id)
+		} else {
+			p.nodeEvent(corev1.EventTypeWarning, reasonClusterUnreachable, "Client cluster %s is unreachable", cl.id)
+		}
+		// 不可用期间缓存中的节点和 pod 可能已经变化，当前的集群容量与当初加上的并不相同，
+		// 不能直接加减，按健康的集群全量重算
+		p.resetCapacity()
+	}
+}
+
+// failoverCluster 在其他可用集群中重建不可用集群上的 pod
+func (c *CasProvider) failoverCluster(ctx context.Context, cl *cluster) {
+	logger := cl.logger(ctx, logging.Failover)
+	pods, err := cl.clientCache.podLister.List(labels.Everything())
+	if err != nil {
+		logger.WithError(err).Error("List pods failed")
+		return
+	}
+	logger.WithField("pods", len(pods)).Warnf("Cluster unreachable for more than %v, recreate its pods elsewhere",
+		c.options().ClusterFailoverTimeout)
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		if owner := c.ownerOf(pod.Namespace, pod.Name); owner == nil || owner.id != cl.id {
+			continue
+		}
+		podLogger := withPod(logger, pod)
+		target := c.pickCluster(ctx, pod, cl.id)
+		if target == nil {
+			podLogger.Warn("No reachable cluster to recreate pod, retry later")
+			return
+		}
+		err := c.createPodInCluster(ctx, target, util.TrimPod(pod))
+		if errors.IsAlreadyExists(err) {
+			c.setOwner(pod.Namespace, pod.Name, target.id)
+		} else if err != nil {
+			podLogger.WithError(err).Errorf("Recreate pod in cluster %s failed", target.id)
+			return
+		}
+		podLogger.Infof("Recreate pod in cluster %s", target.id)
+	}
+	cl.setFailedOver(true)
+}
+
+// cleanupFailedOver 集群恢复后删除已经迁移到其他集群或已被删除的 pod
+func (c *CasProvider) cleanupFailedOver(ctx context.Context, cl *cluster) {
+	cl.setFailedOver(false)
+	logger := cl.logger(ctx, logging.Failover)
+	pods, err := cl.clientCache.podLister.List(labels.Everything())
+	if err != nil {
+		logger.WithError(err).Error("List pods failed")
+		return
+	}
+	for _, pod := range pods {
+		if owner := c.ownerOf(pod.Namespace, pod.Name); owner != nil && owner.id == cl.id {
+			continue
+		}
+		c.markDescheduling(pod.UID)
+		err := cl.client.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{
+			GracePeriodSeconds: new(int64),
+			Preconditions:      metav1.NewUIDPreconditions(string(pod.UID)),
+		})
+		if err != nil && !errors.IsNotFound(err) {
+			c.descheduling.Delete(pod.UID)
+			withPod(logger, pod).WithError(err).Error("Delete stale pod failed")
+			continue
+		}
+		withPod(logger, pod).Info("Delete stale pod in recovered cluster")
+	}
+}
+
+// createPodInCluster 将 pod 的扩展资源转换为该集群的资源后在集群中创建，并记录 pod 所在集群
+func (c *CasProvider) createPodInCluster(ctx context.Context, cl *cluster, pod *corev1.Pod) (err error) {
+	ctx, span := tracing.StartPodSpan(ctx, "CasProvider.createPodInCluster", pod.Namespace, pod.Name)
+	defer endSpan(span, &err)
+	ctx = span.WithField(ctx, tracing.AttrCluster, cl.id)
+	if err := ensureNamespace(ctx, cl, pod.Namespace); err != nil {
+		return err
+	}
+	if err := c.resourceMapping.PodToDownstream(pod, cl.hasResource); err != nil {
+		return fmt.Errorf("could not map resources of pod %s/%s to cluster %s: %v", pod.Namespace, pod.Name, cl.id, err)
+	}
+	pod.Labels[util.ClusterID] = cl.id
+	_, err = cl.client.CoreV1().Pods(pod.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+	c.setOwner(pod.Namespace, pod.Name, cl.id)
+	return nil
+}
+
+// pickCluster 为 pod 在可用集群中选择转发 pod 最少的一个，excludes 中的集群不参与选择
+func (c *CasProvider) pickCluster(ctx context.Context, pod *corev1.Pod, excludes ...string) (picked *cluster) {
+	_, span := tracing.StartPodSpan(ctx, "CasProvider.pickCluster", pod.Namespace, pod.Name)
+	defer func() {
+		if picked == nil {
+			span.SetStatus(errNoCluster)
+		} else {
+			tracing.Annotate(span, tracing.AttrCluster, picked.id)
+		}
+		span.End()
+	}()
+	tracing.Annotate(span, "excludes", strings.Join(excludes, ","))
+	pickedCount := 0
+	for _, cl := range c.clusters {
+		if !cl.isHealthy() || containsString(excludes, cl.id) {
+			continue
+		}
+		count := cl.podCount()
+		if picked == nil || count < pickedCount {
+			picked, pickedCount = cl, count
+		}
+	}
+	return picked
+}
+
+// ownerOf 返回 pod 当前所在的集群，未记录时按可用集群优先的顺序查找
+func (c *CasProvider) ownerOf(namespace, name string) *cluster {
+	if id, ok := c.owners.Load(namespace + "/" + name); ok {
+		return c.clusterByID(id.(string))
+	}
+	var found *cluster
+	for _, cl := range c.clusters {
+		if _, err := cl.clientCache.podLister.Pods(namespace).Get(name); err != nil {
+			continue
+		}
+		if cl.isHealthy() {
+			return cl
+		}
+		if found == nil {
+			found = cl
+		}
+	}
+	return found
+}
+
+// forgetDeleted 已删除的 pod 在所有集群中都不存在后清除其记录
+func (c *CasProvider) forgetDeleted(namespace, name string) {
+	key := namespace + "/" + name
+	if id, ok := c.owners.Load(key); !ok || id.(string) != "" {
+		return
+	}
+	for _, cl := range c.clusters {
+		if _, err := cl.clientCache.podLister.Pods(namespace).Get(name); err == nil {
+			return
+		}
+	}
+	c.owners.Delete(key)
+}
+
+// setOwner 记录 pod 所在的集群 id，id 为空表示 pod 已被删除
+func (c *CasProvider) setOwner(namespace, name, id string) {
+	c.owners.Store(namespace+"/"+name, id)
+}
+
+func (c *CasProvider) clusterByID(id string) *cluster {
+	for _, cl := range c.clusters {
+		if cl.id == id {
+			return cl
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,29 @@
+package providers
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// downstreamNamespace 返回上游 namespace 在下游集群中对应的 namespace
+func (c *CasProvider) downstreamNamespace(namespace string) string {
+	if mapped, ok := c.options().NamespaceMapping[namespace]; ok {
+		return mapped
+	}
+	return namespace
+}
+
+// upstreamNamespace 返回下游 namespace 对应的上游 namespace，映射在校验时保证是一对一的
+func (c *CasProvider) upstreamNamespace(namespace string) string {
+	for from, to := range c.options().NamespaceMapping {
+		if to == namespace {
+			return from
+		}
+	}
+	return namespace
+}
+
+// toUpstream 将下游 pod 的 namespace 换回上游 namespace，pod 必须是副本
+func (c *CasProvider) toUpstream(pod *corev1.Pod) *corev1.Pod {
+	pod.Namespace = c.upstreamNamespace(pod.Namespace)
+	return pod
+}
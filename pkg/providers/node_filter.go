@@ -0,0 +1,101 @@
+package providers
+
+import (
+	"strings"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/common"
+	"github.com/practice/virtual-kubelet-practice/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// nodeSelected 下游节点属于虚拟节点的 zone 且满足 nodeEligible 时才为虚拟节点提供容量
+func (c *CasProvider) nodeSelected(node *corev1.Node) bool {
+	return c.nodeInZone(node) && c.nodeEligible(node)
+}
+
+// nodeEligible 下游节点满足 label selector、没有被排除的污点且平台匹配
+func (c *CasProvider) nodeEligible(node *corev1.Node) bool {
+	if selector := c.config.get().nodeSelector; selector != nil && !selector.Matches(labels.Set(node.Labels)) {
+		return false
+	}
+	if hasExcludedTaint(node, c.options().ExcludeTaints) {
+		return false
+	}
+	return c.nodeMatchesPlatform(node)
+}
+
+// hasExcludedTaint 判断节点是否带有 excludes 中的污点，格式为 key 或 key:effect
+func hasExcludedTaint(node *corev1.Node, excludes []string) bool {
+	for _, taint := range node.Spec.Taints {
+		for _, exclude := range excludes {
+			key, effect := exclude, ""
+			if i := strings.LastIndex(exclude, ":"); i > 0 {
+				key, effect = exclude[:i], exclude[i+1:]
+			}
+			if taint.Key == key && (effect == "" || string(taint.Effect) == effect) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nodeSchedulable 下游节点未被 cordon、没有表示不可调度的污点且 Ready。
+// 其他 NoSchedule/NoExecute 污点（如 dedicated=gpu）不影响容量，因为转发的 pod 带着上游的容忍，
+// 可能仍然可以调度到这些节点上，不希望统计这些节点时通过 ExcludeTaints 排除
+func nodeSchedulable(node *corev1.Node) bool {
+	return !node.Spec.Unschedulable && !hasCordonTaint(node) && checkNodeStatusReady(node)
+}
+
+// hasCordonTaint 节点控制器添加的 not-ready、unreachable、unschedulable 污点与 cordon 等价，
+// 只识别这几个污点，其他污点见 nodeSchedulable
+func hasCordonTaint(node *corev1.Node) bool {
+	for _, taint := range node.Spec.Taints {
+		if taint.Effect != corev1.TaintEffectNoSchedule && taint.Effect != corev1.TaintEffectNoExecute {
+			continue
+		}
+		switch taint.Key {
+		case util.TaintNodeNotReady, util.TaintNodeUnreachable, util.TaintNodeUnschedulable:
+			return true
+		}
+	}
+	return false
+}
+
+// nodeContributes 下游节点可调度且被虚拟节点选中时为虚拟节点提供容量
+func (c *CasProvider) nodeContributes(node *corev1.Node) bool {
+	return nodeSchedulable(node) && c.nodeSelected(node)
+}
+
+// nodeCapacity 返回下游节点按 resourceMapping 转换后为虚拟节点提供的容量，即可分配资源减去节点上已有 pod 的请求
+func (c *CasProvider) nodeCapacity(cl *cluster, node *corev1.Node) *common.Resource {
+	return c.resourceMapping.ToUpstream(cl.nodeCapacity(node))
+}
+
+// nodeAllocatable 返回下游节点按 resourceMapping 转换后的可分配资源
+func (c *CasProvider) nodeAllocatable(node *corev1.Node) *common.Resource {
+	return c.resourceMapping.ToUpstream(common.ConvertResource(node.Status.Allocatable))
+}
+
+// clusterCapacity 返回集群按 resourceMapping 转换后为虚拟节点提供的容量
+func (c *CasProvider) clusterCapacity(cl *cluster) *common.Resource {
+	return c.resourceMapping.ToUpstream(cl.capacity(c.nodeSelected))
+}
+
+// reservation 返回从虚拟节点容量中预留的资源
+func (c *CasProvider) reservation() *common.Resource {
+	return common.ConvertResource(c.options().Reservations)
+}
+
+// contributingNodes 返回可用集群中为虚拟节点提供容量的全部下游节点
+func (c *CasProvider) contributingNodes() []*corev1.Node {
+	var nodes []*corev1.Node
+	for _, cl := range c.clusters {
+		if !cl.isHealthy() {
+			continue
+		}
+		nodes = append(nodes, cl.schedulableNodes(c.nodeSelected)...)
+	}
+	return nodes
+}
@@ -0,0 +1,80 @@
+package providers
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// aggregateLabels 计算配置的 label 在所有提供容量的下游节点上的共同值，
+// 返回一致的 label 以及因为各节点取值不一致或缺失而被去掉的 label key
+func (c *CasProvider) aggregateLabels() (map[string]string, []string) {
+	nodes := c.contributingNodes()
+	common := map[string]string{}
+	var tripped []string
+	if len(nodes) == 0 {
+		return common, tripped
+	}
+	for _, key := range c.options().AggregateLabels {
+		value, uniform := nodes[0].Labels[key]
+		for _, n := range nodes[1:] {
+			if !uniform {
+				break
+			}
+			v, ok := n.Labels[key]
+			uniform = ok && v == value
+		}
+		if uniform {
+			common[key] = value
+		} else {
+			tripped = append(tripped, key)
+		}
+	}
+	sort.Strings(tripped)
+	return common, tripped
+}
+
+// aggregateTaints 返回所有提供容量的下游节点共有的污点
+func (c *CasProvider) aggregateTaints() []corev1.Taint {
+	nodes := c.contributingNodes()
+	if len(nodes) == 0 {
+		return nil
+	}
+	var taints []corev1.Taint
+	for _, taint := range nodes[0].Spec.Taints {
+		shared := true
+		for _, n := range nodes[1:] {
+			if !hasTaint(n, taint) {
+				shared = false
+				break
+			}
+		}
+		if shared {
+			taint.TimeAdded = nil
+			taints = append(taints, taint)
+		}
+	}
+	return taints
+}
+
+func hasTaint(node *corev1.Node, taint corev1.Taint) bool {
+	for _, t := range node.Spec.Taints {
+		if t.MatchTaint(&taint) && t.Value == taint.Value {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshNodeLabels 更新虚拟节点上聚合的 label，并在 util.TrippedLabels 注解中记录被去掉的 label。
+// AggregateLabels 可以在运行时修改，不再聚合的 label 由 SetLabels 去掉，因此列表为空时也要更新
+func (c *CasProvider) refreshNodeLabels() {
+	if c.providerNode.Node == nil {
+		return
+	}
+	labels, tripped := c.aggregateLabels()
+	c.providerNode.SetLabels(c.options().AggregateLabels, labels)
+	c.providerNode.SetAnnotation(util.TrippedLabels, strings.Join(tripped, ","))
+}
@@ -0,0 +1,135 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/logging"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// permission provider 在下游集群中需要的一项权限
+type permission struct {
+	verb     string
+	resource string
+	// optional 缺少时只告警，不影响启动
+	optional bool
+}
+
+func (p permission) String() string {
+	return p.verb + " " + p.resource
+}
+
+// requiredPermissions provider 在下游集群中发出的请求需要的权限，均为全部 namespace 范围，
+// 增减下游 API 调用时需要同步修改。不检查 secrets：pod 引用的 Secret 不会同步到下游（见 CreatePod），
+// provider 从不读写下游的 secrets，要求这项权限只会让只授予最小权限的集群无法启动
+var requiredPermissions = []permission{
+	// 节点 informer
+	{verb: "list", resource: "nodes"},
+	{verb: "watch", resource: "nodes"},
+	// 转发的 pod 以及下游自己的 pod 的 informer
+	{verb: "list", resource: "pods"},
+	{verb: "watch", resource: "pods"},
+	// 转发、更新、删除、重调度和迁移 pod
+	{verb: "create", resource: "pods"},
+	{verb: "update", resource: "pods"},
+	{verb: "delete", resource: "pods"},
+	// ensureNamespace
+	{verb: "get", resource: "namespaces"},
+	{verb: "create", resource: "namespaces"},
+	// 将下游 pod 的事件同步到上游
+	{verb: "list", resource: "events", optional: true},
+	{verb: "watch", resource: "events", optional: true},
+}
+
+// permissionReport 一个下游集群的权限检查结果
+type permissionReport struct {
+	Cluster         string   `json:"cluster"`
+	Missing         []string `json:"missing,omitempty"`
+	MissingOptional []string `json:"missingOptional,omitempty"`
+}
+
+// checkPermissions 通过 SelfSubjectAccessReview 检查 provider 在集群中的权限
+func (cl *cluster) checkPermissions(ctx context.Context) (*permissionReport, error) {
+	report := &permissionReport{Cluster: cl.id}
+	for _, p := range requiredPermissions {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Verb:     p.verb,
+					Resource: p.resource,
+				},
+			},
+		}
+		result, err := cl.client.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("review permission %v in cluster %s: %v", p, cl.id, err)
+		}
+		if result.Status.Allowed {
+			continue
+		}
+		if p.optional {
+			report.MissingOptional = append(report.MissingOptional, p.String())
+		} else {
+			report.Missing = append(report.Missing, p.String())
+		}
+	}
+	return report, nil
+}
+
+// checkClusters 启动前检查每个下游集群是否可以访问以及权限是否足够，无法访问时按 backoff 重试，
+// 输出权限报告，缺少必需权限时返回错误
+func checkClusters(ctx context.Context, clusters []*cluster, backoff wait.Backoff) error {
+	var reports []*permissionReport
+	var errs []string
+	for _, cl := range clusters {
+		if err := cl.probeWithBackoff(ctx, backoff); err != nil {
+			return fmt.Errorf("could not reach client cluster %s: %v", cl.id, err)
+		}
+		report, err := cl.checkPermissions(ctx)
+		if err != nil {
+			return err
+		}
+		reports = append(reports, report)
+		if len(report.Missing) > 0 {
+			errs = append(errs, fmt.Sprintf("cluster %s: %s", cl.id, strings.Join(report.Missing, ", ")))
+		}
+		if len(report.MissingOptional) > 0 {
+			cl.logger(ctx, logging.Provider).WithField("permissions", strings.Join(report.MissingOptional, ", ")).
+				Warn("Cluster lacks optional permissions")
+		}
+	}
+	data, _ := json.Marshal(reports)
+	logging.G(ctx, logging.Provider).WithField("report", string(data)).Info("Client cluster permission report")
+	if len(errs) > 0 {
+		return fmt.Errorf("missing permissions in client clusters: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// probeWithBackoff 探测集群直到成功或 backoff 的重试次数用完，每次探测的超时为 backoff 的当前间隔，
+// 探测很快失败时等到间隔结束再重试
+func (cl *cluster) probeWithBackoff(ctx context.Context, backoff wait.Backoff) error {
+	for {
+		timeout := backoff.Step()
+		start := time.Now()
+		err := cl.probe(ctx, timeout)
+		if err == nil {
+			return nil
+		}
+		if backoff.Steps == 0 {
+			return err
+		}
+		cl.logger(ctx, logging.Provider).WithError(err).Warnf("Probe cluster failed within %v, retry", timeout)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Until(start.Add(timeout))):
+		}
+	}
+}
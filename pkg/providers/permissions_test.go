@@ -0,0 +1,73 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestCheckPermissions(t *testing.T) {
+	cl := newTestCluster("test")
+	denied := map[string]bool{"delete pods": true, "watch events": true}
+	var reviewed []string
+	cl.client.(*fake.Clientset).PrependReactor("create", "selfsubjectaccessreviews",
+		func(action k8stesting.Action) (bool, runtime.Object, error) {
+			review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+			attributes := review.Spec.ResourceAttributes
+			p := permission{verb: attributes.Verb, resource: attributes.Resource}
+			reviewed = append(reviewed, p.String())
+			review.Status.Allowed = !denied[p.String()]
+			return true, review, nil
+		})
+
+	report, err := cl.checkPermissions(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reviewed) != len(requiredPermissions) {
+		t.Fatalf("reviewed %v, want %v", reviewed, requiredPermissions)
+	}
+	if want := []string{"delete pods"}; !reflect.DeepEqual(report.Missing, want) {
+		t.Errorf("missing = %v, want %v", report.Missing, want)
+	}
+	if want := []string{"watch events"}; !reflect.DeepEqual(report.MissingOptional, want) {
+		t.Errorf("missing optional = %v, want %v", report.MissingOptional, want)
+	}
+}
+
+func TestProbeWithBackoffGrowsTimeout(t *testing.T) {
+	// apiserver 响应需要 150ms，只有间隔增长到 200ms 的探测才能成功
+	var probes int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&probes, 1)
+		time.Sleep(150 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"major":"1","minor":"20"}`))
+	}))
+	defer server.Close()
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &cluster{id: "test", client: client}
+
+	backoff := wait.Backoff{Duration: 50 * time.Millisecond, Factor: 2, Steps: 4}
+	if err := cl.probeWithBackoff(context.Background(), backoff); err != nil {
+		t.Fatalf("probe failed after %d attempts: %v", atomic.LoadInt32(&probes), err)
+	}
+	if got := atomic.LoadInt32(&probes); got != 3 {
+		t.Fatalf("probed %d times, want 3", got)
+	}
+}
@@ -0,0 +1,197 @@
+package providers
+
+import (
+	"context"
+	"strings"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/logging"
+	"github.com/practice/virtual-kubelet-practice/pkg/util"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// defaultOS 未配置操作系统时虚拟节点使用的操作系统
+	defaultOS = "linux"
+	// defaultArch 没有可用下游节点时虚拟节点使用的架构
+	defaultArch = "amd64"
+)
+
+// nodeOS 虚拟节点的操作系统，来自 ProviderConfig.OperatingSystem
+func (c *CasProvider) nodeOS() string {
+	if c.options().OperatingSystem == "" {
+		return defaultOS
+	}
+	return strings.ToLower(c.options().OperatingSystem)
+}
+
+// nodeLabel 读取节点的 stable label，不存在时读取 beta label
+func nodeLabel(node *corev1.Node, stable, beta string) string {
+	if value, ok := node.Labels[stable]; ok {
+		return value
+	}
+	return node.Labels[beta]
+}
+
+// nodeMatchesPlatform 下游节点的操作系统与虚拟节点一致，且架构与配置一致时才为虚拟节点提供容量。
+// 未配置架构时所有架构的节点都提供容量，显式要求某个架构的 pod 可以使用这些容量，见 applyArch
+func (c *CasProvider) nodeMatchesPlatform(node *corev1.Node) bool {
+	if os := nodeLabel(node, corev1.LabelOSStable, util.LabelOSBeta); os != "" && os != c.nodeOS() {
+		return false
+	}
+	if c.options().Architecture == "" {
+		return true
+	}
+	arch := nodeLabel(node, corev1.LabelArchStable, util.LabelArchBeta)
+	return arch == "" || arch == c.options().Architecture
+}
+
+// availableArches 统计可用集群中为虚拟节点提供容量的节点的架构及节点数
+func (c *CasProvider) availableArches() map[string]int {
+	arches := map[string]int{}
+	for _, n := range c.contributingNodes() {
+		if arch := nodeLabel(n, corev1.LabelArchStable, util.LabelArchBeta); arch != "" {
+			arches[arch]++
+		}
+	}
+	return arches
+}
+
+// nodeArch 虚拟节点对外展示的架构，配置了架构时使用配置，否则使用下游节点数最多的架构
+func (c *CasProvider) nodeArch() string {
+	if c.options().Architecture != "" {
+		return c.options().Architecture
+	}
+	picked, count := defaultArch, 0
+	for arch, n := range c.availableArches() {
+		if n > count || n == count && arch < picked {
+			picked, count = arch, n
+		}
+	}
+	return picked
+}
+
+// advertisedArch 虚拟节点当前对外展示的架构，上游调度器按它调度没有要求架构的 pod
+func (c *CasProvider) advertisedArch() string {
+	if c.providerNode.Node == nil {
+		return ""
+	}
+	return c.providerNode.DeepCopy().Status.NodeInfo.Architecture
+}
+
+// refreshNodeArch 下游节点加入或离开后重新选择虚拟节点展示的架构
+func (c *CasProvider) refreshNodeArch() {
+	if c.providerNode.Node == nil {
+		return
+	}
+	previous, arch := c.advertisedArch(), c.nodeArch()
+	if arch == previous {
+		return
+	}
+	c.providerNode.SetArchitecture(arch, corev1.LabelArchStable, util.LabelArchBeta)
+	arches := c.availableArches()
+	logger := c.logger(context.Background(), logging.Capacity).WithField("architectures", arches)
+	if len(arches) > 1 {
+		logger.Warnf("Client clusters have mixed architectures, advertise %s to pods without architecture requirement", arch)
+	} else if previous != "" {
+		logger.Infof("Advertise architecture %s instead of %s", arch, previous)
+	}
+}
+
+// applyArch 限制没有要求架构的转发 pod 只能调度到虚拟节点展示的架构的下游节点上。
+// 上游调度器认为虚拟节点只有这一种架构，下游存在多种架构时这些 pod 的镜像不一定能在其他架构上运行
+func (c *CasProvider) applyArch(pod *corev1.Pod) {
+	if podRequestsArch(pod) {
+		return
+	}
+	addNodeRequirement(pod, corev1.NodeSelectorRequirement{
+		Key:      corev1.LabelArchStable,
+		Operator: corev1.NodeSelectorOpIn,
+		Values:   []string{c.advertisedArch()},
+	})
+}
+
+// podRequestsArch 判断 pod 是否通过 nodeSelector 或 node affinity 要求了架构
+func podRequestsArch(pod *corev1.Pod) bool {
+	for _, key := range []string{corev1.LabelArchStable, util.LabelArchBeta} {
+		if _, ok := pod.Spec.NodeSelector[key]; ok {
+			return true
+		}
+	}
+	affinity := pod.Spec.Affinity
+	if affinity == nil || affinity.NodeAffinity == nil ||
+		affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return false
+	}
+	for _, term := range affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		for _, expression := range term.MatchExpressions {
+			if expression.Key == corev1.LabelArchStable || expression.Key == util.LabelArchBeta {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkPodPlatform 检查 pod 通过 nodeSelector 或 node affinity 要求的架构和操作系统在下游是否有容量
+func (c *CasProvider) checkPodPlatform(pod *corev1.Pod) error {
+	for _, key := range []string{corev1.LabelOSStable, util.LabelOSBeta} {
+		if os, ok := pod.Spec.NodeSelector[key]; ok && os != c.nodeOS() {
+			return errdefs.InvalidInputf("pod %s/%s requests os %s, but node only runs %s",
+				pod.Namespace, pod.Name, os, c.nodeOS())
+		}
+	}
+	arches := c.availableArches()
+	for _, key := range []string{corev1.LabelArchStable, util.LabelArchBeta} {
+		if arch, ok := pod.Spec.NodeSelector[key]; ok && arches[arch] == 0 {
+			return errdefs.InvalidInputf("pod %s/%s requests architecture %s, which has no capacity in client clusters",
+				pod.Namespace, pod.Name, arch)
+		}
+	}
+	if !affinityArchSatisfiable(pod, arches) {
+		return errdefs.InvalidInputf("pod %s/%s node affinity requests architectures without capacity in client clusters",
+			pod.Namespace, pod.Name)
+	}
+	return nil
+}
+
+// affinityArchSatisfiable 只要有一个 node selector term 不限制架构或者限制的架构有容量，就认为可以满足
+func affinityArchSatisfiable(pod *corev1.Pod, arches map[string]int) bool {
+	affinity := pod.Spec.Affinity
+	if affinity == nil || affinity.NodeAffinity == nil ||
+		affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return true
+	}
+	terms := affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	if len(terms) == 0 {
+		return true
+	}
+	for _, term := range terms {
+		if termArchSatisfiable(term, arches) {
+			return true
+		}
+	}
+	return false
+}
+
+func termArchSatisfiable(term corev1.NodeSelectorTerm, arches map[string]int) bool {
+	for _, expression := range term.MatchExpressions {
+		if expression.Key != corev1.LabelArchStable && expression.Key != util.LabelArchBeta {
+			continue
+		}
+		if expression.Operator != corev1.NodeSelectorOpIn {
+			continue
+		}
+		found := false
+		for _, arch := range expression.Values {
+			if arches[arch] > 0 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,105 @@
+package providers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func withArch(arch string) func(*corev1.Node) {
+	return func(node *corev1.Node) {
+		node.Labels[corev1.LabelArchStable] = arch
+	}
+}
+
+func TestApplyArch(t *testing.T) {
+	p := newTestProvider(t, nil)
+	p.providerNode.Node = &corev1.Node{Status: corev1.NodeStatus{NodeInfo: corev1.NodeSystemInfo{Architecture: "amd64"}}}
+	archAffinity := &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{
+				{Key: corev1.LabelArchStable, Operator: corev1.NodeSelectorOpIn, Values: []string{"arm64"}},
+			}}},
+		},
+	}}
+
+	tests := []struct {
+		name string
+		spec corev1.PodSpec
+		want []corev1.NodeSelectorRequirement
+	}{
+		{
+			name: "no architecture requirement",
+			want: []corev1.NodeSelectorRequirement{
+				{Key: corev1.LabelArchStable, Operator: corev1.NodeSelectorOpIn, Values: []string{"amd64"}},
+			},
+		},
+		{
+			name: "node selector",
+			spec: corev1.PodSpec{NodeSelector: map[string]string{util.LabelArchBeta: "arm64"}},
+		},
+		{
+			name: "node affinity",
+			spec: corev1.PodSpec{Affinity: archAffinity},
+			want: archAffinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod"}, Spec: *tt.spec.DeepCopy()}
+			p.applyArch(pod)
+			var got []corev1.NodeSelectorRequirement
+			if affinity := pod.Spec.Affinity; affinity != nil {
+				terms := affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+				if len(terms) != 1 {
+					t.Fatalf("unexpected node selector terms %+v", terms)
+				}
+				got = terms[0].MatchExpressions
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("requirements = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefreshNodeArchFollowsNodes(t *testing.T) {
+	cl := newTestCluster("test", testNode("n1", "4", withArch("arm64")), testNode("n2", "4", withArch("amd64")),
+		testNode("n3", "4", withArch("arm64")))
+	p := newTestProvider(t, nil, cl)
+	p.buildNodeInformer(cl, cl.informerFactory.Core().V1().Nodes())
+	startInformers(t, cl)
+	p.ConfigureNode(context.Background(), &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:   p.nodeName,
+		Labels: map[string]string{},
+	}})
+	if got := p.advertisedArch(); got != "arm64" {
+		t.Fatalf("advertised architecture = %s, want arm64", got)
+	}
+
+	nodes := cl.client.CoreV1().Nodes()
+	if err := nodes.Delete(context.Background(), "n3", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"n4", "n5"} {
+		if _, err := nodes.Create(context.Background(), testNode(name, "4", withArch("amd64")), metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return p.advertisedArch() == "amd64", nil
+	})
+	if err != nil {
+		t.Fatalf("advertised architecture = %s, want amd64", p.advertisedArch())
+	}
+	labels := p.providerNode.DeepCopy().Labels
+	if labels[corev1.LabelArchStable] != "amd64" || labels[util.LabelArchBeta] != "amd64" {
+		t.Fatalf("architecture labels = %v, want amd64", labels)
+	}
+}
@@ -2,99 +2,188 @@ package providers
 
 import (
 	"context"
-	"fmt"
 	"github.com/practice/virtual-kubelet-practice/pkg/common"
+	"github.com/practice/virtual-kubelet-practice/pkg/logging"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
 	"github.com/virtual-kubelet/virtual-kubelet/node"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/client-go/informers"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
 	informerv1 "k8s.io/client-go/informers/core/v1"
-	"k8s.io/client-go/kubernetes"
 	v1 "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
-	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type clientCache struct {
 	nodeLister v1.NodeLister
+	podLister  v1.PodLister
+	// hostPodIndexer 下游集群自己的 pod，按 nodeNameIndex 索引
+	hostPodIndexer cache.Indexer
 }
 
 type CasProvider struct {
-	// options 配置
-	options *common.ProviderConfig
+	// config 配置，所有虚拟节点共享，部分字段可以在运行时通过 WatchConfig 修改
+	config *liveConfig
 	// nodeName 节点名称，初始化时必须指定
-	nodeName     string
-	client       *kubernetes.Clientset
-	configured   bool
+	nodeName string
+	// zone 按 zone 拆分虚拟节点时该节点对应的 zone，为空表示主节点
+	zone string
+	// clusters 下游集群，pod 会被放置到其中一个可用的集群
+	clusters []*cluster
+	// configured 为 1 表示 ConfigureNode 已经初始化 providerNode，由 informer 等多个 goroutine 读取
+	configured   int32
 	providerNode *common.ProviderNode
-	updatedNode  chan *corev1.Node
-	clientCache  clientCache
+	// updatedNode 只保留最新的节点状态，合并一段时间内的多次变化后再通知 virtual-kubelet
+	updatedNode *common.NodeNotifier
+
+	// notifyLock 保护 notifyFunc
+	notifyLock sync.Mutex
+	// notifyFunc 由 NotifyPods 注入，下游 pod 状态变化时回调
+	notifyFunc func(*corev1.Pod)
+	// descheduling 记录正在被重调度删除的下游 pod UID，这些 pod 的删除不同步到上游
+	descheduling *sync.Map
+	// owners 记录 pod(namespace/name) 当前所在的集群 id，空字符串表示 pod 已被删除
+	owners *sync.Map
+
+	// resourceMapping 下游扩展资源在虚拟节点上的名称和数量
+	resourceMapping common.ResourceMapping
+	// quota 各 namespace 的资源配额，所有虚拟节点共享
+	quota *namespaceQuota
+
+	// recorder 在虚拟节点和上游 pod 上记录事件，所有虚拟节点共享
+	recorder record.EventRecorder
+
+	// recompute 全量重算容量的请求
+	recompute chan struct{}
+
+	// zonesLock 保护 zones
+	zonesLock sync.Mutex
+	// zones 由主节点创建的各 zone 的虚拟节点，与主节点共享下游集群
+	zones map[string]*CasProvider
 }
 
+// maxSyncTimeout 启动时单次等待下游集群的最长时间
+const maxSyncTimeout = 5 * time.Minute
+
 // 这是vk组件必须实现的两个接口。
 var _ node.PodLifecycleHandler = &CasProvider{}
 var _ node.PodNotifier = &CasProvider{}
 
-func NewCasProvider(ctx context.Context, options *common.ProviderConfig) *CasProvider {
-	config, err := clientcmd.BuildConfigFromFlags("", options.ClientConfig)
+// NewCasProvider 创建 provider，启动前检查下游集群是否可以访问以及权限是否足够，
+// recorder 为上游集群的事件记录器，为 nil 时不记录事件
+func NewCasProvider(ctx context.Context, options *common.ProviderConfig, recorder record.EventRecorder) (*CasProvider, error) {
+	if recorder == nil {
+		recorder = &record.FakeRecorder{}
+	}
+	config, err := newLiveConfig(options)
 	if err != nil {
-		fmt.Println("BuildConfigFromFlags_err:", err)
-		return nil
+		return nil, err
+	}
+	provider := &CasProvider{
+		config:       config,
+		nodeName:     options.NodeName,
+		updatedNode:  common.NewNodeNotifier(),
+		providerNode: &common.ProviderNode{},
+		descheduling: &sync.Map{},
+		owners:       &sync.Map{},
+		zones:        map[string]*CasProvider{},
+		quota:        newNamespaceQuota(),
+		recorder:     recorder,
+		recompute:    make(chan struct{}, 1),
 	}
 
-	clientset, err := kubernetes.NewForConfig(config)
+	mapping, err := common.ParseResourceMapping(options.ResourceMappings)
 	if err != nil {
-		fmt.Println("newforconfig_err:", err)
-		return nil
+		return nil, err
 	}
+	provider.resourceMapping = mapping
 
-	informerFactory := informers.NewSharedInformerFactory(clientset, 0)
-	nodeInformer := informerFactory.Core().V1().Nodes()
+	for _, clusterConfig := range options.ClusterConfigs {
+		cl, err := newCluster(parseClusterConfig(clusterConfig))
+		if err != nil {
+			return nil, err
+		}
+		provider.buildNodeInformer(cl, cl.informerFactory.Core().V1().Nodes())
+		provider.buildPodInformer(cl, cl.podInformerFactory.Core().V1().Pods())
+		provider.clusters = append(provider.clusters, cl)
+	}
+	if len(options.ClusterConfigs) == 0 {
+		cl, err := newCluster(defaultCluster(options))
+		if err != nil {
+			return nil, err
+		}
+		provider.buildNodeInformer(cl, cl.informerFactory.Core().V1().Nodes())
+		provider.buildPodInformer(cl, cl.podInformerFactory.Core().V1().Pods())
+		provider.clusters = append(provider.clusters, cl)
+	}
 
-	provider := &CasProvider{
-		options:  options,
-		nodeName: options.NodeName,
-		client:   clientset,
-		clientCache: clientCache{
-			nodeLister: nodeInformer.Lister(),
-		},
-		updatedNode:  make(chan *corev1.Node, 100),
-		providerNode: &common.ProviderNode{},
+	if err := checkClusters(ctx, provider.clusters, syncBackoff(options)); err != nil {
+		return nil, err
+	}
+	for _, cl := range provider.clusters {
+		cl.logger(ctx, logging.Provider).WithField("credentials", cl.transport.credentials.String()).Info("Use client cluster")
+		if err := cl.start(ctx, syncBackoff(options)); err != nil {
+			return nil, err
+		}
+		go provider.checkClusterHealth(ctx, cl)
 	}
 
-	provider.buildNodeInformer(nodeInformer)
+	if options.DescheduleInterval > 0 {
+		go newDescheduler(provider).run(ctx)
+	}
+	go provider.runRecompute(ctx)
+	if options.MirrorClientEvents {
+		newEventMirror(provider).run(ctx)
+	}
+	providerCollector.add(ctx, provider)
 
-	informerFactory.Start(ctx.Done())
-	informerFactory.WaitForCacheSync(ctx.Done())
+	return provider, nil
+}
 
-	return provider
+// logger 返回该虚拟节点 subsystem 子系统的 logger，保留 ctx 中 virtual-kubelet 和 trace 附加的字段
+func (c *CasProvider) logger(ctx context.Context, subsystem string) log.Logger {
+	return logging.G(ctx, subsystem).WithField(logging.FieldNode, c.nodeName)
 }
 
-func (c *CasProvider) buildNodeInformer(nodeInformer informerv1.NodeInformer) {
+// withPod 为 logger 添加 pod 的 namespace 和 name 字段
+func withPod(logger log.Logger, pod *corev1.Pod) log.Logger {
+	return logger.WithFields(log.Fields{logging.FieldNamespace: pod.Namespace, logging.FieldPod: pod.Name})
+}
+
+// syncBackoff 启动时等待下游集群的退避策略，第一次等待 CacheSyncTimeout，之后每次加倍
+func syncBackoff(options *common.ProviderConfig) wait.Backoff {
+	return wait.Backoff{
+		Duration: options.CacheSyncTimeout,
+		Factor:   2,
+		Steps:    options.CacheSyncRetries + 1,
+		Cap:      maxSyncTimeout,
+	}
+}
+
+func (c *CasProvider) buildNodeInformer(cl *cluster, nodeInformer informerv1.NodeInformer) {
 
 	nodeInformer.Informer().AddEventHandler(
 		cache.ResourceEventHandlerFuncs{
-			//添加节点时无需addresource，因为新加入的节点从notready变为ready时会触发update，在updatefunc里面进行addresource
+			// 节点加入时可能已经 Ready，因此新增时就要加上容量。informer relist 时已存在的节点
+			// 收到 update 事件，新出现的节点收到 add 事件，消失的节点收到 delete 事件
 			AddFunc: func(obj interface{}) {
-				/*if !c.configured {
+				if !c.isConfigured() || !cl.isHealthy() {
 					return
 				}
-				nodeCopy := c.providerNode.DeepCopy()
-				addNode := obj.(*corev1.Node).DeepCopy()
-				fmt.Println(addNode.Name)
-				toAdd := common.ConvertResource(addNode.Status.Capacity)
-				if err := c.providerNode.AddResource(toAdd); err != nil {
+				addNode, ok := obj.(*corev1.Node)
+				if !ok {
 					return
 				}
-				// resource we did not add when ConfigureNode should sub
-				//p.providerNode.SubResource(p.getResourceFromPodsByNodeName(addNode.Name))
-				copy := c.providerNode.DeepCopy()
-				if !reflect.DeepEqual(nodeCopy, copy) {
-					c.updatedNode <- copy
-				}*/
+				c.updateVKCapacityFromNode(cl, nil, addNode.DeepCopy())
 			},
 			UpdateFunc: func(oldObj, newObj interface{}) {
-				if !c.configured {
+				if !c.isConfigured() || !cl.isHealthy() {
 					return
 				}
 				old, ok1 := oldObj.(*corev1.Node)
@@ -104,32 +193,134 @@ func (c *CasProvider) buildNodeInformer(nodeInformer informerv1.NodeInformer) {
 				if !ok1 || !ok2 {
 					return
 				}
-				c.updateVKCapacityFromNode(oldCopy, newCopy)
+				c.updateVKCapacityFromNode(cl, oldCopy, newCopy)
 			},
 			DeleteFunc: func(obj interface{}) {
-				if !c.configured {
+				if !c.isConfigured() || !cl.isHealthy() {
 					return
 				}
-				deleteNode := obj.(*corev1.Node).DeepCopy()
-				if deleteNode.Spec.Unschedulable || !checkNodeStatusReady(deleteNode) {
+				var deleteNode *corev1.Node
+				switch t := obj.(type) {
+				case *corev1.Node:
+					deleteNode = t.DeepCopy()
+				case cache.DeletedFinalStateUnknown:
+					node, ok := t.Obj.(*corev1.Node)
+					if !ok {
+						return
+					}
+					deleteNode = node.DeepCopy()
+				default:
 					return
 				}
-				nodeCopy := c.providerNode.DeepCopy()
-				toRemove := common.ConvertResource(deleteNode.Status.Capacity)
-				if err := c.providerNode.SubResource(toRemove); err != nil {
+				c.updateVKCapacityFromNode(cl, deleteNode, nil)
+			},
+		},
+	)
+}
+
+func (c *CasProvider) buildPodInformer(cl *cluster, podInformer informerv1.PodInformer) {
+
+	podInformer.Informer().AddEventHandler(
+		cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				old, ok1 := oldObj.(*corev1.Pod)
+				new, ok2 := newObj.(*corev1.Pod)
+				if !ok1 || !ok2 || !c.ownsPod(new) {
 					return
 				}
-				// resource we did not add when ConfigureNode should add
-				//p.providerNode.AddResource(p.getResourceFromPodsByNodeName(deleteNode.Name))
-				copy := c.providerNode.DeepCopy()
-				if !reflect.DeepEqual(nodeCopy, copy) {
-					c.updatedNode <- copy
+				if reflect.DeepEqual(old.Status, new.Status) &&
+					reflect.DeepEqual(old.DeletionTimestamp, new.DeletionTimestamp) {
+					return
 				}
+				c.recordImagePullFailures(old, new)
+				c.notifyPod(cl, new.DeepCopy())
+			},
+			DeleteFunc: func(obj interface{}) {
+				var deletePod *corev1.Pod
+				switch t := obj.(type) {
+				case *corev1.Pod:
+					deletePod = t.DeepCopy()
+				case cache.DeletedFinalStateUnknown:
+					pod, ok := t.Obj.(*corev1.Pod)
+					if !ok {
+						return
+					}
+					deletePod = pod.DeepCopy()
+				default:
+					return
+				}
+				if !c.ownsPod(deletePod) {
+					return
+				}
+				c.forgetDeleted(deletePod.Namespace, deletePod.Name)
+				if _, ok := c.descheduling.Load(deletePod.UID); ok {
+					c.descheduling.Delete(deletePod.UID)
+					return
+				}
+				// 下游 pod 被直接删除时，标记删除时间让上游 pod 同步删除
+				if deletePod.DeletionTimestamp == nil {
+					now := metav1.Now()
+					deletePod.DeletionTimestamp = &now
+				}
+				c.notifyPod(cl, deletePod)
 			},
 		},
 	)
 }
 
+// notifyPod 将下游 pod 状态回调给 virtual-kubelet，只同步 pod 当前所在集群的状态
+func (c *CasProvider) notifyPod(cl *cluster, pod *corev1.Pod) {
+	if _, ok := c.descheduling.Load(pod.UID); ok {
+		return
+	}
+	if owner := c.ownerOf(pod.Namespace, pod.Name); owner == nil || owner.id != cl.id {
+		return
+	}
+	c.notifyLock.Lock()
+	f := c.notifyFunc
+	c.notifyLock.Unlock()
+	if f == nil {
+		return
+	}
+	f(c.toUpstream(pod))
+}
+
+// failPod 下游 pod 已被删除且无法重新创建时，将上游 pod 标记为 Failed 并记录事件，
+// 否则上游 pod 会一直保持删除前的状态
+func (c *CasProvider) failPod(pod *corev1.Pod, reason, message string) {
+	c.owners.Delete(pod.Namespace + "/" + pod.Name)
+	c.recorder.Event(c.upstreamPodRef(pod), corev1.EventTypeWarning, reason, message)
+	failed := pod.DeepCopy()
+	now := metav1.Now()
+	failed.Status.Phase = corev1.PodFailed
+	failed.Status.Reason = reason
+	failed.Status.Message = message
+	for i := range failed.Status.ContainerStatuses {
+		status := &failed.Status.ContainerStatuses[i]
+		if status.State.Terminated != nil {
+			continue
+		}
+		status.Ready = false
+		status.State = corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{
+			ExitCode:   1,
+			Reason:     reason,
+			Message:    message,
+			FinishedAt: now,
+		}}
+	}
+	c.notifyLock.Lock()
+	f := c.notifyFunc
+	c.notifyLock.Unlock()
+	if f != nil {
+		f(c.toUpstream(failed))
+	}
+}
+
+// markDescheduling 标记 pod 正在被重调度，其删除事件不会同步到上游
+func (c *CasProvider) markDescheduling(uid types.UID) {
+	c.descheduling.Store(uid, struct{}{})
+}
+
 func checkNodeStatusReady(node *corev1.Node) bool {
 	for _, condition := range node.Status.Conditions {
 		if condition.Type != corev1.NodeReady {
@@ -142,35 +333,55 @@ func checkNodeStatusReady(node *corev1.Node) bool {
 	return false
 }
 
-func compareNodeStatusReady(old, new *corev1.Node) (bool, bool) {
-	return checkNodeStatusReady(old), checkNodeStatusReady(new)
-}
-
-func (c *CasProvider) updateVKCapacityFromNode(old, new *corev1.Node) {
-	oldStatus, newStatus := compareNodeStatusReady(old, new)
-	if !oldStatus && !newStatus {
+// updateVKCapacityFromNode 根据下游节点变化前后是否提供容量调整虚拟节点容量，
+// old 为 nil 表示节点新增，new 为 nil 表示节点删除。cordon、不可调度的污点、NotReady
+// 以及不再被选中都视为节点不再提供容量
+func (c *CasProvider) updateVKCapacityFromNode(cl *cluster, old, new *corev1.Node) {
+	// 不可用集群的容量已经从虚拟节点中去掉，恢复时会全量重算
+	if c.providerNode.Node == nil || !cl.isHealthy() {
 		return
 	}
-	toRemove := common.ConvertResource(old.Status.Capacity)
-	toAdd := common.ConvertResource(new.Status.Capacity)
-	nodeCopy := c.providerNode.DeepCopy()
-
-	if c.providerNode.Node == nil {
+	oldContributes := old != nil && c.nodeContributes(old)
+	newContributes := new != nil && c.nodeContributes(new)
+	if !oldContributes && !newContributes {
 		return
-	} else if old.Spec.Unschedulable && !new.Spec.Unschedulable || newStatus && !oldStatus {
-		c.providerNode.AddResource(toAdd)
-		//v.providerNode.SubResource(v.getResourceFromPodsByNodeName(old.Name))
-	} else if !old.Spec.Unschedulable && new.Spec.Unschedulable || oldStatus && !newStatus {
-		//v.providerNode.AddResource(v.getResourceFromPodsByNodeName(old.Name))
-		c.providerNode.SubResource(toRemove)
-
-	} else if !reflect.DeepEqual(old.Status.Allocatable, new.Status.Allocatable) ||
-		!reflect.DeepEqual(old.Status.Capacity, new.Status.Capacity) {
-		c.providerNode.AddResource(toAdd)
-		c.providerNode.SubResource(toRemove)
-	}
-	copy := c.providerNode.DeepCopy()
-	if !reflect.DeepEqual(nodeCopy, copy) {
-		c.updatedNode <- copy
 	}
+	nodeCopy := c.providerNode.DeepCopy()
+	delta := common.NewResource()
+	switch {
+	case !oldContributes:
+		delta.Add(c.nodeCapacity(cl, new))
+		c.recordClientNodeChange(cl, new, true)
+	case !newContributes:
+		delta.Sub(c.nodeCapacity(cl, old))
+		c.recordClientNodeChange(cl, old, false)
+	case !reflect.DeepEqual(old.Status.Allocatable, new.Status.Allocatable):
+		// 节点上的 pod 不变，只需要加上可分配资源的变化
+		delta.Add(c.nodeAllocatable(new))
+		delta.Sub(c.nodeAllocatable(old))
+	}
+	if changed := describeResource(delta); changed != "" {
+		c.providerNode.AddResource(delta)
+		clientNode := new
+		if clientNode == nil {
+			clientNode = old
+		}
+		c.logger(context.Background(), logging.Capacity).WithFields(log.Fields{
+			logging.FieldCluster: cl.id,
+			"clientNode":         clientNode.Name,
+			"delta":              changed,
+		}).Debug("Client node changed capacity")
+	}
+	c.refreshNodeStatus()
+	c.pushNodeUpdate(nodeCopy)
+}
+
+// isConfigured 返回 ConfigureNode 是否已经初始化 providerNode，之前不维护容量
+func (c *CasProvider) isConfigured() bool {
+	return atomic.LoadInt32(&c.configured) == 1
+}
+
+// setConfigured 在 providerNode 初始化后调用，之后的读取能看到初始化的节点
+func (c *CasProvider) setConfigured() {
+	atomic.StoreInt32(&c.configured, 1)
 }
@@ -0,0 +1,321 @@
+package providers
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/common"
+	"github.com/practice/virtual-kubelet-practice/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	v1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// newTestProvider 返回使用给定下游集群的 provider，options 为 nil 时使用默认配置
+func newTestProvider(t *testing.T, options *common.ProviderConfig, clusters ...*cluster) *CasProvider {
+	t.Helper()
+	if options == nil {
+		options = common.NewProviderConfig()
+	}
+	if options.NodeName == "" {
+		options.NodeName = "vk"
+	}
+	config, err := newLiveConfig(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &CasProvider{
+		config:       config,
+		nodeName:     options.NodeName,
+		clusters:     clusters,
+		updatedNode:  common.NewNodeNotifier(),
+		providerNode: &common.ProviderNode{},
+		descheduling: &sync.Map{},
+		owners:       &sync.Map{},
+		zones:        map[string]*CasProvider{},
+		quota:        newNamespaceQuota(),
+		recorder:     record.NewFakeRecorder(100),
+		recompute:    make(chan struct{}, 1),
+	}
+}
+
+func testNode(name, cpu string, mutate ...func(*corev1.Node)) *corev1.Node {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{corev1.LabelOSStable: "linux"},
+		},
+		Status: corev1.NodeStatus{
+			Capacity:    corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(cpu)},
+			Allocatable: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(cpu)},
+			Conditions: []corev1.NodeCondition{
+				{Type: corev1.NodeReady, Status: corev1.ConditionTrue},
+			},
+		},
+	}
+	for _, m := range mutate {
+		m(node)
+	}
+	return node
+}
+
+func testPod(name, nodeName, cpu string, forwarded bool) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec: corev1.PodSpec{
+			NodeName: nodeName,
+			Containers: []corev1.Container{{
+				Name: "c",
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(cpu)},
+				},
+			}},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	if forwarded {
+		pod.Labels = map[string]string{util.VirtualPodLabel: "true"}
+	}
+	return pod
+}
+
+func cordoned(node *corev1.Node) { node.Spec.Unschedulable = true }
+
+func notReady(node *corev1.Node) { node.Status.Conditions[0].Status = corev1.ConditionFalse }
+
+func tainted(key string, effect corev1.TaintEffect) func(*corev1.Node) {
+	return func(node *corev1.Node) {
+		node.Spec.Taints = append(node.Spec.Taints, corev1.Taint{Key: key, Effect: effect})
+	}
+}
+
+func TestNodeInformerUpdatesCapacity(t *testing.T) {
+	// sentinel 在每个用例的操作之后创建，同一个 handler 按顺序处理事件，
+	// 看到 sentinel 的容量说明之前的事件已经处理完
+	const sentinelCPU = 100
+	tests := []struct {
+		name     string
+		existing *corev1.Node
+		pods     []runtime.Object
+		action   func(ctx context.Context, nodes v1.NodeInterface) error
+		wantCPU  int64
+	}{
+		{
+			name: "add ready node",
+			action: func(ctx context.Context, nodes v1.NodeInterface) error {
+				_, err := nodes.Create(ctx, testNode("n1", "4"), metav1.CreateOptions{})
+				return err
+			},
+			wantCPU: 4,
+		},
+		{
+			name: "add not ready node",
+			action: func(ctx context.Context, nodes v1.NodeInterface) error {
+				_, err := nodes.Create(ctx, testNode("n1", "4", notReady), metav1.CreateOptions{})
+				return err
+			},
+			wantCPU: 0,
+		},
+		{
+			name: "add node with pods",
+			pods: []runtime.Object{
+				testPod("host", "n1", "1", false),
+				testPod("forwarded", "n1", "1", true),
+				testPod("other-node", "n2", "1", false),
+			},
+			action: func(ctx context.Context, nodes v1.NodeInterface) error {
+				_, err := nodes.Create(ctx, testNode("n1", "4"), metav1.CreateOptions{})
+				return err
+			},
+			// 只减去 n1 上不是虚拟节点转发的 pod
+			wantCPU: 3,
+		},
+		{
+			name:     "update capacity",
+			existing: testNode("n1", "4"),
+			action: func(ctx context.Context, nodes v1.NodeInterface) error {
+				_, err := nodes.Update(ctx, testNode("n1", "8"), metav1.UpdateOptions{})
+				return err
+			},
+			wantCPU: 8,
+		},
+		{
+			name:     "node becomes ready",
+			existing: testNode("n1", "4", notReady),
+			action: func(ctx context.Context, nodes v1.NodeInterface) error {
+				_, err := nodes.Update(ctx, testNode("n1", "4"), metav1.UpdateOptions{})
+				return err
+			},
+			wantCPU: 4,
+		},
+		{
+			name:     "delete node",
+			existing: testNode("n1", "4"),
+			action: func(ctx context.Context, nodes v1.NodeInterface) error {
+				return nodes.Delete(ctx, "n1", metav1.DeleteOptions{})
+			},
+			wantCPU: 0,
+		},
+		{
+			name:     "delete node with pods",
+			existing: testNode("n1", "4"),
+			pods:     []runtime.Object{testPod("host", "n1", "1", false)},
+			action: func(ctx context.Context, nodes v1.NodeInterface) error {
+				return nodes.Delete(ctx, "n1", metav1.DeleteOptions{})
+			},
+			wantCPU: 0,
+		},
+		{
+			name:     "cordon node",
+			existing: testNode("n1", "4"),
+			action: func(ctx context.Context, nodes v1.NodeInterface) error {
+				_, err := nodes.Update(ctx, testNode("n1", "4", cordoned), metav1.UpdateOptions{})
+				return err
+			},
+			wantCPU: 0,
+		},
+		{
+			name:     "uncordon node",
+			existing: testNode("n1", "4", cordoned),
+			action: func(ctx context.Context, nodes v1.NodeInterface) error {
+				_, err := nodes.Update(ctx, testNode("n1", "4"), metav1.UpdateOptions{})
+				return err
+			},
+			wantCPU: 4,
+		},
+		{
+			name:     "unreachable taint",
+			existing: testNode("n1", "4"),
+			action: func(ctx context.Context, nodes v1.NodeInterface) error {
+				node := testNode("n1", "4", tainted(corev1.TaintNodeUnreachable, corev1.TaintEffectNoExecute))
+				_, err := nodes.Update(ctx, node, metav1.UpdateOptions{})
+				return err
+			},
+			wantCPU: 0,
+		},
+		{
+			name:     "unschedulable taint removed",
+			existing: testNode("n1", "4", tainted(corev1.TaintNodeUnschedulable, corev1.TaintEffectNoSchedule)),
+			action: func(ctx context.Context, nodes v1.NodeInterface) error {
+				_, err := nodes.Update(ctx, testNode("n1", "4"), metav1.UpdateOptions{})
+				return err
+			},
+			wantCPU: 4,
+		},
+		{
+			name:     "excluded taint",
+			existing: testNode("n1", "4"),
+			action: func(ctx context.Context, nodes v1.NodeInterface) error {
+				node := testNode("n1", "4", tainted("node-role.kubernetes.io/master", corev1.TaintEffectNoSchedule))
+				_, err := nodes.Update(ctx, node, metav1.UpdateOptions{})
+				return err
+			},
+			wantCPU: 0,
+		},
+		{
+			name:     "other NoSchedule taint keeps capacity",
+			existing: testNode("n1", "4"),
+			action: func(ctx context.Context, nodes v1.NodeInterface) error {
+				node := testNode("n1", "4", tainted("dedicated", corev1.TaintEffectNoSchedule))
+				_, err := nodes.Update(ctx, node, metav1.UpdateOptions{})
+				return err
+			},
+			wantCPU: 4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects := tt.pods
+			if tt.existing != nil {
+				objects = append(objects, tt.existing)
+			}
+			cl := newTestCluster("test", objects...)
+			p := newTestProvider(t, nil, cl)
+			p.providerNode.Node = &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: p.nodeName}}
+			p.setConfigured()
+			p.buildNodeInformer(cl, cl.informerFactory.Core().V1().Nodes())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			cl.startInformers(ctx.Done())
+			if pending := cl.waitForCacheSync(ctx, 10*time.Second); len(pending) != 0 {
+				t.Fatalf("informers %v not synced", pending)
+			}
+
+			nodes := cl.client.CoreV1().Nodes()
+			if err := tt.action(ctx, nodes); err != nil {
+				t.Fatal(err)
+			}
+			sentinel := testNode("sentinel", strconv.Itoa(sentinelCPU))
+			if _, err := nodes.Create(ctx, sentinel, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			want := (tt.wantCPU + sentinelCPU) * 1000
+			var got int64
+			err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+				cpu := p.providerNode.DeepCopy().Status.Capacity[corev1.ResourceCPU]
+				got = cpu.MilliValue()
+				return got == want, nil
+			})
+			if err != nil {
+				t.Fatalf("virtual node cpu = %dm, want %dm", got-sentinelCPU*1000, tt.wantCPU*1000)
+			}
+		})
+	}
+}
+
+func TestClusterHealthChangeResetsCapacity(t *testing.T) {
+	a := newTestCluster("a", testNode("a1", "4"))
+	b := newTestCluster("b", testNode("b1", "8"))
+	p := newTestProvider(t, nil, a, b)
+	p.providerNode.Node = &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: p.nodeName}}
+	p.setConfigured()
+	startInformers(t, a)
+	startInformers(t, b)
+	cpu := func() int64 {
+		quantity := p.providerNode.DeepCopy().Status.Capacity[corev1.ResourceCPU]
+		return quantity.Value()
+	}
+	ctx := context.Background()
+
+	p.resetCapacity()
+	if got := cpu(); got != 12 {
+		t.Fatalf("initial cpu = %d, want 12", got)
+	}
+
+	b.recordProbe(context.DeadlineExceeded, 1)
+	p.onClusterHealthChanged(ctx, b, false)
+	if got := cpu(); got != 4 {
+		t.Fatalf("cpu after cluster b unreachable = %d, want 4", got)
+	}
+
+	// 不可用期间集群 b 的节点发生了变化，不计入虚拟节点，恢复时按当前的节点计算而不是加回原来的容量
+	b2 := testNode("b2", "2")
+	if _, err := b.client.CoreV1().Nodes().Create(ctx, b2, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	p.updateVKCapacityFromNode(b, nil, b2)
+	if got := cpu(); got != 4 {
+		t.Fatalf("cpu after node added to unreachable cluster b = %d, want 4", got)
+	}
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		_, err := b.clientCache.nodeLister.Get("b2")
+		return err == nil, nil
+	})
+	if err != nil {
+		t.Fatal("node b2 not synced")
+	}
+	b.recordProbe(nil, 1)
+	p.onClusterHealthChanged(ctx, b, true)
+	if got := cpu(); got != 14 {
+		t.Fatalf("cpu after cluster b reachable = %d, want 14", got)
+	}
+}
@@ -0,0 +1,218 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/common"
+	"github.com/practice/virtual-kubelet-practice/pkg/logging"
+	"github.com/practice/virtual-kubelet-practice/pkg/util"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// defaultQuotaKey 配置中未单独列出的 namespace 使用的配额
+	defaultQuotaKey = "*"
+	// pendingTimeout 已创建但还未出现在缓存中的 pod 最多计入用量的时间
+	pendingTimeout = time.Minute
+)
+
+// namespaceQuota 限制每个上游 namespace 通过虚拟节点在下游使用的资源，
+// 配额来自上游集群的 ConfigMap，key 为 namespace（* 表示默认），value 为 YAML 格式的 ResourceList，例如
+//
+//	team-a: |
+//	  cpu: "10"
+//	  memory: 20Gi
+//	  pods: "50"
+type namespaceQuota struct {
+	// lock 串行化配额检查与预留，避免并发创建的 pod 同时通过检查，保护 pending
+	lock sync.Mutex
+
+	limitsLock sync.RWMutex
+	limits     map[string]corev1.ResourceList
+
+	// pending 正在创建或已创建但还未同步到下游缓存的 pod(namespace/name)
+	pending map[string]pendingPod
+}
+
+type pendingPod struct {
+	request *common.Resource
+	created time.Time
+}
+
+func newNamespaceQuota() *namespaceQuota {
+	return &namespaceQuota{pending: map[string]pendingPod{}}
+}
+
+// WatchQuota 监听上游集群中 namespace/name 的 ConfigMap 并以其内容作为各 namespace 的配额，直到 ctx 结束
+func (c *CasProvider) WatchQuota(ctx context.Context, client kubernetes.Interface, configMap string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(configMap)
+	if err != nil {
+		return fmt.Errorf("invalid quota configmap %q: %v", configMap, err)
+	}
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}))
+	q := c.quota
+	logger := logging.G(ctx, logging.Quota).WithField("configmap", configMap)
+	factory.Core().V1().ConfigMaps().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			q.load(logger, obj.(*corev1.ConfigMap))
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			q.load(logger, newObj.(*corev1.ConfigMap))
+		},
+		DeleteFunc: func(obj interface{}) {
+			logger.Warn("Quota configmap deleted, namespaces are no longer limited")
+			q.setLimits(nil)
+		},
+	})
+	factory.Start(ctx.Done())
+	return nil
+}
+
+// load 解析 ConfigMap 中的配额，无法解析的 namespace 会被跳过
+func (q *namespaceQuota) load(logger log.Logger, cm *corev1.ConfigMap) {
+	limits := map[string]corev1.ResourceList{}
+	for namespace, value := range cm.Data {
+		list := corev1.ResourceList{}
+		if err := yaml.Unmarshal([]byte(value), &list); err != nil {
+			logger.WithError(err).WithField(logging.FieldNamespace, namespace).Error("Parse quota of namespace failed")
+			continue
+		}
+		limits[namespace] = list
+	}
+	logger.WithField("namespaces", len(limits)).Info("Load quota")
+	q.setLimits(limits)
+}
+
+func (q *namespaceQuota) setLimits(limits map[string]corev1.ResourceList) {
+	q.limitsLock.Lock()
+	q.limits = limits
+	q.limitsLock.Unlock()
+}
+
+// limitOf 返回 namespace 的配额，没有配额时返回 nil
+func (q *namespaceQuota) limitOf(namespace string) corev1.ResourceList {
+	q.limitsLock.RLock()
+	defer q.limitsLock.RUnlock()
+	if limit, ok := q.limits[namespace]; ok {
+		return limit
+	}
+	return q.limits[defaultQuotaKey]
+}
+
+// createWithinQuota 检查 pod 是否会使 namespace 超出配额，未超出时预留 pod 的用量后调用 create，
+// create 失败时释放预留。create 会访问下游 apiserver，调用期间不持有 quota.lock
+func (c *CasProvider) createWithinQuota(pod *corev1.Pod, create func() error) error {
+	q := c.quota
+	limit := q.limitOf(pod.Namespace)
+	if limit == nil {
+		return create()
+	}
+	key := pod.Namespace + "/" + pod.Name
+	if err := c.reserveQuota(key, pod, limit); err != nil {
+		return err
+	}
+	err := create()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if err != nil {
+		delete(q.pending, key)
+		return err
+	}
+	// 预留在 pod 出现在缓存中之前一直计入用量，从创建完成时开始计算超时
+	if p, ok := q.pending[key]; ok {
+		p.created = time.Now()
+		q.pending[key] = p
+	}
+	return nil
+}
+
+// reserveQuota 检查 pod 是否会使 namespace 超出配额，未超出时将 pod 的请求记入 pending
+func (c *CasProvider) reserveQuota(key string, pod *corev1.Pod, limit corev1.ResourceList) error {
+	q := c.quota
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	request := util.GetRequestFromPod(pod)
+	request.Pods = resource.MustParse("1")
+	used := c.namespaceUsage(pod.Namespace)
+	total := common.NewResource()
+	total.Add(used)
+	total.Add(request)
+	if exceeded := exceededResources(total.List(), limit); len(exceeded) > 0 {
+		var details []string
+		for _, name := range exceeded {
+			usedQuantity, requested, hard := used.List()[name], request.List()[name], limit[name]
+			details = append(details, fmt.Sprintf("%s: requested %s, used %s, limited %s",
+				name, requested.String(), usedQuantity.String(), hard.String()))
+		}
+		return fmt.Errorf("%w of namespace %s on virtual node: %s", errQuotaExceeded, pod.Namespace, strings.Join(details, "; "))
+	}
+	q.pending[key] = pendingPod{request: request, created: time.Now()}
+	return nil
+}
+
+// namespaceUsage 汇总 namespace 中转发到下游且未结束、未被删除的 pod 的资源请求，调用方需持有 quota.lock。
+// 正在删除的 pod 不计入，同名 pod 重建时它的预留也不会因为旧 pod 还在缓存中被清除
+func (c *CasProvider) namespaceUsage(namespace string) *common.Resource {
+	usage := common.NewResource()
+	seen := map[string]bool{}
+	for _, cl := range c.clusters {
+		pods, err := cl.clientCache.podLister.Pods(c.downstreamNamespace(namespace)).List(labels.Everything())
+		if err != nil {
+			continue
+		}
+		for _, pod := range pods {
+			// failover 期间同一个 pod 可能同时存在于多个集群，只计算一次
+			if seen[pod.Name] || pod.DeletionTimestamp != nil ||
+				pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+				continue
+			}
+			seen[pod.Name] = true
+			// 下游 pod 的扩展资源已按 resourceMapping 转换，需要转换回上游资源再与配额比较
+			request := c.resourceMapping.ToUpstream(util.GetRequestFromPod(pod))
+			request.Pods = resource.MustParse("1")
+			usage.Add(request)
+		}
+	}
+	for key, p := range c.quota.pending {
+		ns, name, _ := cache.SplitMetaNamespaceKey(key)
+		if seen[name] && ns == namespace || time.Since(p.created) > pendingTimeout {
+			delete(c.quota.pending, key)
+			continue
+		}
+		if ns == namespace {
+			usage.Add(p.request)
+		}
+	}
+	return usage
+}
+
+// exceededResources 返回 used 中超过 limit 的资源名，只检查 limit 中列出的资源
+func exceededResources(used, limit corev1.ResourceList) []corev1.ResourceName {
+	var exceeded []corev1.ResourceName
+	for name, hard := range limit {
+		if quantity, ok := used[name]; ok && quantity.Cmp(hard) > 0 {
+			exceeded = append(exceeded, name)
+		}
+	}
+	sort.Slice(exceeded, func(i, j int) bool { return exceeded[i] < exceeded[j] })
+	return exceeded
+}
@@ -0,0 +1,77 @@
+package providers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func newQuotaTestProvider(t *testing.T, pods ...runtime.Object) *CasProvider {
+	t.Helper()
+	cl := newTestCluster("test", pods...)
+	startInformers(t, cl)
+	p := newTestProvider(t, nil, cl)
+	p.quota.setLimits(map[string]corev1.ResourceList{
+		"default": {corev1.ResourcePods: resource.MustParse("1")},
+	})
+	return p
+}
+
+func TestCreateWithinQuotaDoesNotHoldLockDuringCreate(t *testing.T) {
+	p := newQuotaTestProvider(t)
+	creating := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- p.createWithinQuota(testPod("first", "", "1", false), func() error {
+			close(creating)
+			<-release
+			return nil
+		})
+	}()
+	<-creating
+
+	// 第一个 pod 仍在创建，它的预留已经计入用量，第二个 pod 应该立即被拒绝而不是等待
+	result := make(chan error)
+	go func() {
+		result <- p.createWithinQuota(testPod("second", "", "1", false), func() error { return nil })
+	}()
+	select {
+	case err := <-result:
+		if !errors.Is(err, errQuotaExceeded) {
+			t.Fatalf("second pod: err = %v, want %v", err, errQuotaExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("quota check blocked by an in-flight create")
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateWithinQuotaReleasesReservationOnFailure(t *testing.T) {
+	p := newQuotaTestProvider(t)
+	errCreate := errors.New("create failed")
+	err := p.createWithinQuota(testPod("first", "", "1", false), func() error { return errCreate })
+	if !errors.Is(err, errCreate) {
+		t.Fatalf("err = %v, want %v", err, errCreate)
+	}
+	if err := p.createWithinQuota(testPod("second", "", "1", false), func() error { return nil }); err != nil {
+		t.Fatalf("reservation of the failed pod is not released: %v", err)
+	}
+}
+
+func TestNamespaceUsageSkipsDeletingPods(t *testing.T) {
+	deleting := testPod("old", "n1", "1", true)
+	deleting.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	p := newQuotaTestProvider(t, deleting)
+	if err := p.createWithinQuota(testPod("new", "", "1", false), func() error { return nil }); err != nil {
+		t.Fatalf("deleting pod counted in usage: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/common"
+	"github.com/practice/virtual-kubelet-practice/pkg/logging"
+	"github.com/practice/virtual-kubelet-practice/pkg/metrics"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// TriggerRecompute 请求一次虚拟节点容量的全量重算，不会阻塞调用方
+func (c *CasProvider) TriggerRecompute() {
+	select {
+	case c.recompute <- struct{}{}:
+	default:
+	}
+}
+
+// runRecompute 周期性以及收到请求时根据 nodeLister 全量重算所有虚拟节点的容量，直到 ctx 结束，
+// CapacityRecomputeInterval 为 0 时只在收到请求时重算
+func (c *CasProvider) runRecompute(ctx context.Context) {
+	if interval := c.options().CapacityRecomputeInterval; interval > 0 {
+		go wait.Until(c.TriggerRecompute, interval, ctx.Done())
+	}
+	for {
+		select {
+		case <-c.recompute:
+			for _, p := range c.nodeProviders() {
+				p.recomputeCapacity()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// expectedCapacity 根据健康的下游集群的缓存计算虚拟节点应有的容量
+func (c *CasProvider) expectedCapacity() *common.Resource {
+	expected := common.NewResource()
+	for _, cl := range c.clusters {
+		if !cl.isHealthy() {
+			continue
+		}
+		expected.Add(c.clusterCapacity(cl))
+	}
+	expected.Sub(c.reservation())
+	return expected
+}
+
+// resetCapacity 用 expectedCapacity 替换虚拟节点的容量，用于集群健康状态变化这类预期内的变化，不记录偏差
+func (c *CasProvider) resetCapacity() {
+	if !c.isConfigured() {
+		return
+	}
+	nodeCopy := c.providerNode.DeepCopy()
+	c.providerNode.SetResource(c.expectedCapacity())
+	c.refreshNodeStatus()
+	c.pushNodeUpdate(nodeCopy)
+}
+
+// recomputeCapacity 用下游节点的实际容量替换增量维护的容量，并记录两者的偏差
+func (c *CasProvider) recomputeCapacity() {
+	if !c.isConfigured() {
+		return
+	}
+	expected := c.expectedCapacity()
+
+	nodeCopy := c.providerNode.DeepCopy()
+	drift := common.ConvertResource(nodeCopy.Status.Capacity)
+	drift.Sub(expected)
+	drifted := c.recordDrift(drift)
+	if drifted {
+		c.logger(context.Background(), logging.Capacity).WithField("drift", describeResource(drift)).
+			Warn("Capacity drifted from client clusters, reset it")
+	}
+	metrics.CapacityRecomputations.WithLabelValues(c.nodeName, strconv.FormatBool(drifted)).Inc()
+
+	c.providerNode.SetResource(expected)
+	c.refreshNodeStatus()
+	c.pushNodeUpdate(nodeCopy)
+}
+
+// recordDrift 更新偏差指标，返回是否存在偏差
+func (c *CasProvider) recordDrift(drift *common.Resource) bool {
+	drifted := false
+	for name, quantity := range drift.List() {
+		if !quantity.IsZero() {
+			drifted = true
+		}
+		metrics.CapacityDrift.WithLabelValues(c.nodeName, string(name)).Set(metrics.Quantity(quantity))
+	}
+	return drifted
+}
+
+// describeResource 输出非零的资源，用于日志
+func describeResource(r *common.Resource) string {
+	var parts []string
+	for name, quantity := range r.List() {
+		if !quantity.IsZero() {
+			parts = append(parts, fmt.Sprintf("%s=%s", name, quantity.String()))
+		}
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,160 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/practice/virtual-kubelet-practice/pkg/common"
+	"github.com/practice/virtual-kubelet-practice/pkg/logging"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// reloadDelay 配置文件变化后等待写入完成的时间，期间的多次变化只重新加载一次
+const reloadDelay = time.Second
+
+// liveConfig 可在运行时替换的配置，所有虚拟节点共享
+type liveConfig struct {
+	value atomic.Value
+}
+
+// liveState 配置以及由配置解析出的对象
+type liveState struct {
+	config *common.ProviderConfig
+	// nodeSelector 选择为虚拟节点提供容量的下游节点，为空时选择全部节点
+	nodeSelector labels.Selector
+}
+
+func newLiveConfig(config *common.ProviderConfig) (*liveConfig, error) {
+	l := &liveConfig{}
+	if err := l.set(config); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *liveConfig) get() *liveState {
+	return l.value.Load().(*liveState)
+}
+
+func (l *liveConfig) set(config *common.ProviderConfig) error {
+	state := &liveState{config: config}
+	if config.NodeSelector != "" {
+		selector, err := labels.Parse(config.NodeSelector)
+		if err != nil {
+			return fmt.Errorf("parse node selector %q: %v", config.NodeSelector, err)
+		}
+		state.nodeSelector = selector
+	}
+	l.value.Store(state)
+	return nil
+}
+
+// options 返回当前的配置，调用方不能修改
+func (c *CasProvider) options() *common.ProviderConfig {
+	return c.config.get().config
+}
+
+// reloadableFields 可以在运行时修改的配置，修改后会全量重算容量、label 和 condition
+var reloadableFields = []string{
+	"NodeSelector",
+	"ExcludeTaints",
+	"AggregateLabels",
+	"Reservations",
+	"NodePressureThreshold",
+	"DescheduleThreshold",
+	"MaxDescheduleCount",
+	"ClusterFailureThreshold",
+	"ClusterFailoverTimeout",
+}
+
+// WatchConfig 监听配置文件所在目录，文件变化时通过 load 重新生成配置并应用可以在运行时修改的部分，直到 ctx 结束。
+// 监听目录而不是文件，这样以 ConfigMap 挂载的配置通过替换符号链接更新时也能感知
+func (c *CasProvider) WatchConfig(ctx context.Context, path string, load func() (*common.ProviderConfig, error)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("watch provider config %s: %v", path, err)
+	}
+	logger := c.logger(ctx, logging.Config).WithField("path", path)
+	go func() {
+		defer watcher.Close()
+		var timer <-chan time.Time
+		for {
+			select {
+			case event := <-watcher.Events:
+				// ConfigMap 更新时变化的是 ..data 符号链接，因此目录中的任何变化都重新加载
+				logger.WithField("event", event.String()).Debug("Provider config directory changed")
+				timer = time.After(reloadDelay)
+			case err := <-watcher.Errors:
+				logger.WithError(err).Error("Watch provider config failed")
+			case <-timer:
+				timer = nil
+				config, err := load()
+				if err != nil {
+					logger.WithError(err).Error("Reload provider config failed")
+					continue
+				}
+				c.reload(logger, config)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	logger.Info("Watch provider config")
+	return nil
+}
+
+// reload 应用新配置，包含无法在运行时修改的变化时拒绝整个配置
+func (c *CasProvider) reload(logger log.Logger, config *common.ProviderConfig) {
+	current := c.options()
+	if diff := configDiff(current, config); len(diff) == 0 {
+		return
+	} else if unsafe := unsafeChanges(diff); len(unsafe) > 0 {
+		logger.WithField("changes", strings.Join(unsafe, "; ")).Error("Reject provider config, these changes require a restart")
+		return
+	} else if err := c.config.set(config); err != nil {
+		logger.WithError(err).Error("Reject provider config")
+		return
+	} else {
+		logger.WithField("changes", strings.Join(diff, "; ")).Info("Reload provider config")
+	}
+	c.TriggerRecompute()
+}
+
+// configDiff 返回两个配置中取值不同的字段，格式为 field: old -> new
+func configDiff(old, new *common.ProviderConfig) []string {
+	var diff []string
+	oldValue, newValue := reflect.ValueOf(*old), reflect.ValueOf(*new)
+	for i := 0; i < oldValue.NumField(); i++ {
+		field := oldValue.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		o, n := oldValue.Field(i).Interface(), newValue.Field(i).Interface()
+		if !reflect.DeepEqual(o, n) {
+			diff = append(diff, fmt.Sprintf("%s: %v -> %v", field.Name, o, n))
+		}
+	}
+	return diff
+}
+
+// unsafeChanges 返回 diff 中不能在运行时修改的变化
+func unsafeChanges(diff []string) []string {
+	var unsafe []string
+	for _, d := range diff {
+		if !containsString(reloadableFields, d[:strings.Index(d, ":")]) {
+			unsafe = append(unsafe, d)
+		}
+	}
+	return unsafe
+}
@@ -0,0 +1,76 @@
+package providers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/util"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestReloadAggregateLabels(t *testing.T) {
+	labeled := func(disk, rack string) func(*corev1.Node) {
+		return func(node *corev1.Node) {
+			node.Labels["disk"] = disk
+			node.Labels["rack"] = rack
+		}
+	}
+	cl := newTestCluster("test", testNode("n1", "4", labeled("ssd", "r1")), testNode("n2", "4", labeled("ssd", "r2")))
+	p := newTestProvider(t, nil, cl)
+	startInformers(t, cl)
+	p.providerNode.Node = &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   p.nodeName,
+			Labels: map[string]string{"type": "virtual-kubelet", corev1.LabelArchStable: "amd64"},
+		},
+		Status: corev1.NodeStatus{NodeInfo: corev1.NodeSystemInfo{Architecture: "amd64"}},
+	}
+	p.setConfigured()
+
+	tests := []struct {
+		name            string
+		aggregateLabels []string
+		wantLabels      map[string]string
+		wantTripped     string
+	}{
+		{
+			name:            "aggregate disk and rack",
+			aggregateLabels: []string{"disk", "rack"},
+			wantLabels:      map[string]string{"type": "virtual-kubelet", "disk": "ssd", corev1.LabelArchStable: "amd64"},
+			wantTripped:     "rack",
+		},
+		{
+			name:            "drop disk",
+			aggregateLabels: []string{"rack"},
+			wantLabels:      map[string]string{"type": "virtual-kubelet", corev1.LabelArchStable: "amd64"},
+			wantTripped:     "rack",
+		},
+		{
+			name:            "add disk back",
+			aggregateLabels: []string{"disk"},
+			wantLabels:      map[string]string{"type": "virtual-kubelet", "disk": "ssd", corev1.LabelArchStable: "amd64"},
+		},
+		{
+			name:       "empty list",
+			wantLabels: map[string]string{"type": "virtual-kubelet", corev1.LabelArchStable: "amd64"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := *p.options()
+			config.AggregateLabels = tt.aggregateLabels
+			p.reload(log.L, &config)
+			p.recomputeCapacity()
+
+			node := p.providerNode.DeepCopy()
+			if !reflect.DeepEqual(node.Labels, tt.wantLabels) {
+				t.Errorf("labels = %v, want %v", node.Labels, tt.wantLabels)
+			}
+			if got := node.Annotations[util.TrippedLabels]; got != tt.wantTripped {
+				t.Errorf("tripped labels = %q, want %q", got, tt.wantTripped)
+			}
+		})
+	}
+}
@@ -4,48 +4,224 @@ import (
 	"context"
 	"fmt"
 	"github.com/practice/virtual-kubelet-practice/pkg/common"
+	"github.com/practice/virtual-kubelet-practice/pkg/logging"
+	"github.com/practice/virtual-kubelet-practice/pkg/metrics"
+	"github.com/practice/virtual-kubelet-practice/pkg/tracing"
 	"github.com/practice/virtual-kubelet-practice/pkg/util"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
 	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
 	"io"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
-	"k8s.io/klog"
+	"time"
 )
 
-// CreatePod 创建pod
-func (c *CasProvider) CreatePod(ctx context.Context, pod *corev1.Pod) error {
+// CreatePod 创建pod，将上游 pod 转发到一个可用的下游集群
+// pod 引用的 Secret、ConfigMap 不会同步到下游，需要预先在下游集群中创建，因此也没有对应的 span
+func (c *CasProvider) CreatePod(ctx context.Context, pod *corev1.Pod) (err error) {
+	ctx, span := tracing.StartPodSpan(ctx, "CasProvider.CreatePod", pod.Namespace, pod.Name)
+	defer endSpan(span, &err)
+	defer func(start time.Time) { observePodOperation("create", start, err) }(time.Now())
+	var cl *cluster
+	defer func() { c.recordCreateResult(pod, cl, err) }()
+	if err := c.checkPodPlatform(pod); err != nil {
+		return err
+	}
+	cl = c.pickCluster(ctx, pod)
+	if cl == nil {
+		return fmt.Errorf("could not create pod %s/%s: %w", pod.Namespace, pod.Name, errNoCluster)
+	}
+	ctx = span.WithField(ctx, tracing.AttrCluster, cl.id)
+	basePod := util.TrimPod(pod)
+	basePod.Namespace = c.downstreamNamespace(pod.Namespace)
+	c.applyZone(basePod)
+	c.applyArch(basePod)
+	err = c.createWithinQuota(pod, func() error {
+		if err := c.createPodInCluster(ctx, cl, basePod); err != nil && !errors.IsAlreadyExists(err) {
+			return fmt.Errorf("could not create pod %s/%s in client cluster %s: %w", pod.Namespace, pod.Name, cl.id, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	withPod(c.logger(ctx, logging.Provider), pod).WithField(logging.FieldCluster, cl.id).Info("Create pod in client cluster")
 	return nil
 }
 
-// UpdatePod 更新pod
-func (c *CasProvider) UpdatePod(ctx context.Context, pod *corev1.Pod) error {
+// ensureNamespace 确保下游集群存在对应的 namespace
+func ensureNamespace(ctx context.Context, cl *cluster, namespace string) (err error) {
+	ctx, span := trace.StartSpan(ctx, "ensureNamespace")
+	defer endSpan(span, &err)
+	ctx = span.WithField(ctx, tracing.AttrNamespace, namespace)
+	ctx = span.WithField(ctx, tracing.AttrCluster, cl.id)
+	_, err = cl.client.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err == nil {
+		return nil
+	}
+	if !errors.IsNotFound(err) {
+		return err
+	}
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}
+	_, err = cl.client.CoreV1().Namespaces().Create(ctx, ns, metav1.CreateOptions{})
+	if err != nil && !errors.IsAlreadyExists(err) {
+		return fmt.Errorf("could not create namespace %s in client cluster %s: %v", namespace, cl.id, err)
+	}
 	return nil
 }
 
-// DeletePod 删除pod
-func (c *CasProvider) DeletePod(ctx context.Context, pod *corev1.Pod) error {
+// findPod 返回 pod 所在的集群以及缓存中的 pod
+func (c *CasProvider) findPod(namespace, name string) (*cluster, *corev1.Pod, error) {
+	cl := c.ownerOf(namespace, name)
+	if cl == nil {
+		return nil, nil, errdefs.NotFoundf("pod %s/%s not found in client cluster", namespace, name)
+	}
+	pod, err := cl.clientCache.podLister.Pods(namespace).Get(name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil, errdefs.NotFoundf("pod %s/%s not found in client cluster %s", namespace, name, cl.id)
+		}
+		return nil, nil, err
+	}
+	return cl, pod, nil
+}
+
+// UpdatePod 更新pod，只同步 pod 创建后允许修改的字段
+func (c *CasProvider) UpdatePod(ctx context.Context, pod *corev1.Pod) (err error) {
+	ctx, span := tracing.StartPodSpan(ctx, "CasProvider.UpdatePod", pod.Namespace, pod.Name)
+	defer endSpan(span, &err)
+	namespace := c.downstreamNamespace(pod.Namespace)
+	cl, current, err := c.findPod(namespace, pod.Name)
+	if err != nil {
+		return err
+	}
+	ctx = span.WithField(ctx, tracing.AttrCluster, cl.id)
+	basePod := util.TrimPod(pod)
+	podCopy := current.DeepCopy()
+	podCopy.Labels = basePod.Labels
+	podCopy.Labels[util.ClusterID] = cl.id
+	podCopy.Annotations = basePod.Annotations
+	// 重调度相关的注解只存在于下游，更新时需要保留
+	for _, key := range []string{util.CreatedbyDescheduler, util.DescheduleCount} {
+		if value, ok := current.Annotations[key]; ok {
+			if podCopy.Annotations == nil {
+				podCopy.Annotations = map[string]string{}
+			}
+			podCopy.Annotations[key] = value
+		}
+	}
+	podCopy.Spec.ActiveDeadlineSeconds = basePod.Spec.ActiveDeadlineSeconds
+	podCopy.Spec.Tolerations = basePod.Spec.Tolerations
+	for i := range podCopy.Spec.Containers {
+		if i < len(basePod.Spec.Containers) {
+			podCopy.Spec.Containers[i].Image = basePod.Spec.Containers[i].Image
+		}
+	}
+	for i := range podCopy.Spec.InitContainers {
+		if i < len(basePod.Spec.InitContainers) {
+			podCopy.Spec.InitContainers[i].Image = basePod.Spec.InitContainers[i].Image
+		}
+	}
+	_, err = cl.client.CoreV1().Pods(namespace).Update(ctx, podCopy, metav1.UpdateOptions{})
+	return err
+}
+
+// DeletePod 删除pod，不可用集群上残留的副本会在集群恢复后清理
+func (c *CasProvider) DeletePod(ctx context.Context, pod *corev1.Pod) (err error) {
+	ctx, span := tracing.StartPodSpan(ctx, "CasProvider.DeletePod", pod.Namespace, pod.Name)
+	defer endSpan(span, &err)
+	defer func(start time.Time) { observePodOperation("delete", start, err) }(time.Now())
+	namespace := c.downstreamNamespace(pod.Namespace)
+	opts := metav1.DeleteOptions{GracePeriodSeconds: pod.DeletionGracePeriodSeconds}
+	found := false
+	stale := false
+	for _, cl := range c.clusters {
+		if _, err := cl.clientCache.podLister.Pods(namespace).Get(pod.Name); err != nil {
+			continue
+		}
+		if !cl.isHealthy() {
+			stale = true
+			continue
+		}
+		err := cl.client.CoreV1().Pods(namespace).Delete(ctx, pod.Name, opts)
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		found = true
+		withPod(c.logger(ctx, logging.Provider), pod).WithField(logging.FieldCluster, cl.id).Info("Delete pod in client cluster")
+	}
+	if stale {
+		c.setOwner(namespace, pod.Name, "")
+	} else {
+		c.owners.Delete(namespace + "/" + pod.Name)
+	}
+	if !found && !stale {
+		return errdefs.NotFoundf("pod %s/%s not found in client cluster", pod.Namespace, pod.Name)
+	}
 	return nil
 }
 
 // GetPod 获取pod
-func (c *CasProvider) GetPod(ctx context.Context, namespace, name string) (*corev1.Pod, error) {
-	return &corev1.Pod{}, nil
+func (c *CasProvider) GetPod(ctx context.Context, namespace, name string) (_ *corev1.Pod, err error) {
+	_, span := tracing.StartPodSpan(ctx, "CasProvider.GetPod", namespace, name)
+	defer endSpan(span, &err)
+	cl, pod, err := c.findPod(c.downstreamNamespace(namespace), name)
+	if err != nil {
+		return nil, err
+	}
+	tracing.Annotate(span, tracing.AttrCluster, cl.id)
+	return c.toUpstream(pod.DeepCopy()), nil
 }
 
 // GetPodStatus 获取pod状态
-func (c *CasProvider) GetPodStatus(ctx context.Context, namespace, name string) (*corev1.PodStatus, error) {
-	return &corev1.PodStatus{}, nil
+func (c *CasProvider) GetPodStatus(ctx context.Context, namespace, name string) (_ *corev1.PodStatus, err error) {
+	ctx, span := tracing.StartPodSpan(ctx, "CasProvider.GetPodStatus", namespace, name)
+	defer endSpan(span, &err)
+	pod, err := c.GetPod(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	return &pod.Status, nil
 }
 
-// GetPods 获取pod列表
-func (c *CasProvider) GetPods(ctx context.Context) ([]*corev1.Pod, error) {
-	return nil, nil
+// GetPods 获取pod列表，每个 pod 只返回其当前所在集群中的副本
+func (c *CasProvider) GetPods(ctx context.Context) (_ []*corev1.Pod, err error) {
+	_, span := trace.StartSpan(ctx, "CasProvider.GetPods")
+	defer endSpan(span, &err)
+	var podsCopy []*corev1.Pod
+	for _, cl := range c.clusters {
+		pods, err := cl.clientCache.podLister.List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		for _, pod := range pods {
+			if !c.ownsPod(pod) {
+				continue
+			}
+			if owner := c.ownerOf(pod.Namespace, pod.Name); owner == nil || owner.id != cl.id {
+				continue
+			}
+			podsCopy = append(podsCopy, c.toUpstream(pod.DeepCopy()))
+		}
+	}
+	tracing.Annotate(span, "pods", int64(len(podsCopy)))
+	return podsCopy, nil
+}
+
+// endSpan 以 *err 的最终取值设置 span 的状态并结束 span
+func endSpan(span trace.Span, err *error) {
+	span.SetStatus(*err)
+	span.End()
 }
 
 // NotifyPods 异步更新pod的状态。
 func (c *CasProvider) NotifyPods(ctx context.Context, notifyStatus func(*corev1.Pod)) {
-
+	c.notifyLock.Lock()
+	c.notifyFunc = notifyStatus
+	c.notifyLock.Unlock()
 }
 
 // GetContainerLogs 获取容器日志
@@ -60,56 +236,54 @@ func (c *CasProvider) RunInContainer(ctx context.Context, namespace, podName, co
 
 // ConfigureNode 初始化自定义node节点信息
 func (c *CasProvider) ConfigureNode(ctx context.Context, node *corev1.Node) {
-	nodes, err := c.clientCache.nodeLister.List(labels.Everything())
-	if err != nil {
-		return
-	}
-
 	nodeResource := common.NewResource()
-
-	for _, n := range nodes {
-		if n.Spec.Unschedulable {
+	for _, cl := range c.clusters {
+		if !cl.isHealthy() {
 			continue
 		}
-		if !checkNodeStatusReady(n) {
-			klog.Infof("Node %v not ready", node.Name)
-			continue
-		}
-		nc := common.ConvertResource(n.Status.Capacity)
-		nodeResource.Add(nc)
+		nodeResource.Add(c.clusterCapacity(cl))
 	}
+	nodeResource.Sub(c.reservation())
 	nodeResource.SetCapacityToNode(node)
-	node.Status.NodeInfo.OperatingSystem = "linux"
-	node.Status.NodeInfo.Architecture = "amd64"
-	node.ObjectMeta.Labels[corev1.LabelArchStable] = "amd64"
-	node.ObjectMeta.Labels[corev1.LabelOSStable] = "linux"
-	node.ObjectMeta.Labels[util.LabelOSBeta] = "linux"
-	node.Status.Conditions = nodeConditions()
+	nodeOS := c.nodeOS()
+	node.Status.NodeInfo.OperatingSystem = nodeOS
+	node.ObjectMeta.Labels[corev1.LabelOSStable] = nodeOS
+	node.ObjectMeta.Labels[util.LabelOSBeta] = nodeOS
+	if c.zone != "" {
+		node.ObjectMeta.Labels[c.options().ZoneLabel] = c.zone
+	}
+	node.Status.Conditions = c.nodeConditions(nil)
 	node.Status.Addresses = []corev1.NodeAddress{
 		{
 			Type:    corev1.NodeInternalIP,
-			Address: "127.0.0.1",
+			Address: c.internalIP(),
 		},
 		{
 			Type:    corev1.NodeHostName,
 			Address: c.nodeName,
 		},
 	}
+	node.Status.DaemonEndpoints = c.nodeDaemonEndpoints()
+	// 污点属于 node spec，virtual-kubelet 只在注册节点时使用，之后的变化不会同步
+	node.Spec.Taints = append(node.Spec.Taints, c.aggregateTaints()...)
 	c.providerNode.Node = node
-	c.configured = true
+	c.refreshNodeArch()
+	c.refreshNodeLabels()
+	c.setConfigured()
 	return
 }
 
 // Ping tries to connect to client cluster
 // implement node.NodeProvider
 func (c *CasProvider) Ping(ctx context.Context) error {
-
-	_, err := c.client.Discovery().ServerVersion()
-	if err != nil {
-		klog.Error("Failed ping")
-		return fmt.Errorf("could not list client apiserver statuses: %v", err)
+	// 只要还有一个下游集群可用，虚拟节点就是可用的，单个集群的故障由 checkClusterHealth 处理
+	for _, cl := range c.clusters {
+		if cl.isHealthy() {
+			return nil
+		}
 	}
-	return nil
+	c.logger(ctx, logging.Failover).Error("Ping failed, no client cluster is reachable")
+	return fmt.Errorf("could not reach any client cluster")
 }
 
 // NotifyNodeStatus is used to asynchronously monitor the node.
@@ -120,18 +294,13 @@ func (c *CasProvider) Ping(ctx context.Context) error {
 //
 // NotifyNodeStatus should not block callers.
 func (c *CasProvider) NotifyNodeStatus(ctx context.Context, f func(*corev1.Node)) {
-	klog.Info("Called NotifyNodeStatus")
-	go func() {
-		for {
-			select {
-			case node := <-c.updatedNode:
-				klog.Infof("Enqueue updated node %v", node.Name)
-				f(node)
-			case <-ctx.Done():
-				return
-			}
-		}
-	}()
+	logger := c.logger(ctx, logging.Capacity)
+	logger.Debug("Called NotifyNodeStatus")
+	go c.updatedNode.Run(ctx, c.options().NodeUpdateWindow, func(node *corev1.Node) {
+		logger.Debug("Enqueue updated node")
+		metrics.NodeStatusUpdates.WithLabelValues(node.Name).Inc()
+		f(node)
+	})
 }
 
 // nodeDaemonEndpoints returns NodeDaemonEndpoints for the node status
@@ -139,99 +308,23 @@ func (c *CasProvider) NotifyNodeStatus(ctx context.Context, f func(*corev1.Node)
 func (c *CasProvider) nodeDaemonEndpoints() corev1.NodeDaemonEndpoints {
 	return corev1.NodeDaemonEndpoints{
 		KubeletEndpoint: corev1.DaemonEndpoint{
-			//Port: c.daemonPort,
+			Port: c.daemonPort(),
 		},
 	}
 }
 
-// getResourceFromPods summary the resource already used by pods.
-func (c *CasProvider) getResourceFromPods() *common.Resource {
-	podResource := common.NewResource()
-	/*pods, err := v.clientCache.podLister.List(labels.Everything())
-	if err != nil {
-		return podResource
-	}
-	for _, pod := range pods {
-		if pod.Status.Phase == corev1.PodPending && pod.Spec.NodeName != "" ||
-			pod.Status.Phase == corev1.PodRunning {
-			nodeName := pod.Spec.NodeName
-			node, err := v.clientCache.nodeLister.Get(nodeName)
-			if err != nil {
-				klog.Infof("get node %v failed err: %v", nodeName, err)
-				continue
-			}
-			if node.Spec.Unschedulable || !checkNodeStatusReady(node) {
-				continue
-			}
-			res := util.GetRequestFromPod(pod)
-			res.Pods = resource.MustParse("1")
-			podResource.Add(res)
-		}
-	}*/
-	return podResource
-}
-
-// getResourceFromPodsByNodeName summary the resource already used by pods according to nodeName
-func (c *CasProvider) getResourceFromPodsByNodeName(nodeName string) *common.Resource {
-	podResource := common.NewResource()
-	/*fieldSelector, err := fields.ParseSelector("spec.nodeName=" + nodeName)
-	pods, err := v.client.CoreV1().Pods(corev1.NamespaceAll).List(context.TODO(),
-		metav1.ListOptions{
-			FieldSelector: fieldSelector.String(),
-		})
-	if err != nil {
-		return podResource
+// internalIP returns the address of the virtual kubelet, detected when it is not configured
+func (c *CasProvider) internalIP() string {
+	if c.options().InternalIp != "" {
+		return c.options().InternalIp
 	}
-	for _, pod := range pods.Items {
-		if util.IsVirtualPod(&pod) {
-			continue
-		}
-		if pod.Status.Phase == corev1.PodPending ||
-			pod.Status.Phase == corev1.PodRunning {
-			res := util.GetRequestFromPod(&pod)
-			res.Pods = resource.MustParse("1")
-			podResource.Add(res)
-		}
-	}*/
-	return podResource
+	return util.DetectInternalIP()
 }
 
-// nodeConditions creates a slice of node conditions representing a
-// kubelet in perfect health. These four conditions are the ones which virtual-kubelet
-// sets as Unknown when a Ping fails.
-func nodeConditions() []corev1.NodeCondition {
-	return []corev1.NodeCondition{
-		{
-			Type:               "Ready",
-			Status:             corev1.ConditionTrue,
-			LastHeartbeatTime:  metav1.Now(),
-			LastTransitionTime: metav1.Now(),
-			Reason:             "KubeletReady",
-			Message:            "kubelet is posting ready status",
-		},
-		{
-			Type:               "MemoryPressure",
-			Status:             corev1.ConditionFalse,
-			LastHeartbeatTime:  metav1.Now(),
-			LastTransitionTime: metav1.Now(),
-			Reason:             "KubeletHasSufficientMemory",
-			Message:            "kubelet has sufficient memory available",
-		},
-		{
-			Type:               "DiskPressure",
-			Status:             corev1.ConditionFalse,
-			LastHeartbeatTime:  metav1.Now(),
-			LastTransitionTime: metav1.Now(),
-			Reason:             "KubeletHasNoDiskPressure",
-			Message:            "kubelet has no disk pressure",
-		},
-		{
-			Type:               "PIDPressure",
-			Status:             corev1.ConditionFalse,
-			LastHeartbeatTime:  metav1.Now(),
-			LastTransitionTime: metav1.Now(),
-			Reason:             "KubeletHasSufficientPID",
-			Message:            "kubelet has sufficient PID available",
-		},
+// daemonPort returns the port the virtual kubelet serves logs and exec on
+func (c *CasProvider) daemonPort() int32 {
+	if c.options().DaemonEndpointPort != 0 {
+		return c.options().DaemonEndpointPort
 	}
+	return common.DefaultDaemonEndpointPort
 }
@@ -0,0 +1,144 @@
+package providers
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/common"
+	"github.com/practice/virtual-kubelet-practice/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// invalidNodeNameChars 节点名中不允许出现的字符
+var invalidNodeNameChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// NodeName 返回虚拟节点名称
+func (c *CasProvider) NodeName() string {
+	return c.nodeName
+}
+
+// Zones 返回可用集群中可以提供容量的下游节点的 ZoneLabel 取值，未开启 zone 拆分时返回空
+func (c *CasProvider) Zones() []string {
+	if c.options().ZoneLabel == "" {
+		return nil
+	}
+	seen := map[string]bool{}
+	var zones []string
+	for _, cl := range c.clusters {
+		if !cl.isHealthy() {
+			continue
+		}
+		for _, n := range cl.schedulableNodes(c.nodeEligible) {
+			zone, ok := n.Labels[c.options().ZoneLabel]
+			if !ok || seen[zone] {
+				continue
+			}
+			seen[zone] = true
+			zones = append(zones, zone)
+		}
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// NewZoneProvider 为 zone 创建一个虚拟节点，它与主节点共享下游集群和 informer，
+// 但有自己的容量账本，只统计该 zone 中的下游节点
+func (c *CasProvider) NewZoneProvider(zone string) *CasProvider {
+	c.zonesLock.Lock()
+	defer c.zonesLock.Unlock()
+	if zp, ok := c.zones[zone]; ok {
+		return zp
+	}
+	zp := &CasProvider{
+		config:       c.config,
+		nodeName:     zoneNodeName(c.nodeName, zone),
+		zone:         zone,
+		clusters:     c.clusters,
+		updatedNode:  common.NewNodeNotifier(),
+		providerNode: &common.ProviderNode{},
+		descheduling: c.descheduling,
+		owners:       c.owners,
+		quota:        c.quota,
+		recorder:     c.recorder,
+
+		resourceMapping: c.resourceMapping,
+	}
+	for _, cl := range c.clusters {
+		zp.buildNodeInformer(cl, cl.informerFactory.Core().V1().Nodes())
+		zp.buildPodInformer(cl, cl.podInformerFactory.Core().V1().Pods())
+	}
+	c.zones[zone] = zp
+	return zp
+}
+
+// zoneNodeName 返回 zone 对应的虚拟节点名称
+func zoneNodeName(nodeName, zone string) string {
+	suffix := invalidNodeNameChars.ReplaceAllString(strings.ToLower(zone), "-")
+	return nodeName + "-" + strings.Trim(suffix, "-.")
+}
+
+// nodeProviders 返回主节点以及所有 zone 的虚拟节点
+func (c *CasProvider) nodeProviders() []*CasProvider {
+	providers := []*CasProvider{c}
+	c.zonesLock.Lock()
+	defer c.zonesLock.Unlock()
+	for _, zp := range c.zones {
+		providers = append(providers, zp)
+	}
+	return providers
+}
+
+// nodeInZone 开启 zone 拆分时，zone 虚拟节点只统计该 zone 的下游节点，主节点只统计没有 zone label 的下游节点，
+// 每个下游节点的容量只被一个虚拟节点提供
+func (c *CasProvider) nodeInZone(node *corev1.Node) bool {
+	if c.options().ZoneLabel == "" {
+		return true
+	}
+	zone, ok := node.Labels[c.options().ZoneLabel]
+	if c.zone == "" {
+		return !ok
+	}
+	return ok && zone == c.zone
+}
+
+// conditionNodes 返回决定虚拟节点 condition 的下游节点。zone 模式下主节点由 node-cli 注册，
+// 所有下游节点都有 zone label 时它没有容量，但仍按所有 zone 的节点计算 condition，避免一直 NotReady
+func (c *CasProvider) conditionNodes() []*corev1.Node {
+	if c.options().ZoneLabel == "" || c.zone != "" {
+		return c.contributingNodes()
+	}
+	var nodes []*corev1.Node
+	for _, cl := range c.clusters {
+		if !cl.isHealthy() {
+			continue
+		}
+		nodes = append(nodes, cl.schedulableNodes(c.nodeEligible)...)
+	}
+	return nodes
+}
+
+// applyZone 限制转发的 pod 只能调度到虚拟节点对应 zone 的下游节点上，主节点的 pod 只能调度到没有 zone label 的节点上
+func (c *CasProvider) applyZone(pod *corev1.Pod) {
+	if c.options().ZoneLabel == "" {
+		return
+	}
+	requirement := corev1.NodeSelectorRequirement{
+		Key:      c.options().ZoneLabel,
+		Operator: corev1.NodeSelectorOpDoesNotExist,
+	}
+	if c.zone != "" {
+		requirement.Operator = corev1.NodeSelectorOpIn
+		requirement.Values = []string{c.zone}
+	}
+	addNodeRequirement(pod, requirement)
+}
+
+// ownsPod 判断下游 pod 是否属于当前虚拟节点，没有记录虚拟节点的 pod 属于主节点
+func (c *CasProvider) ownsPod(pod *corev1.Pod) bool {
+	nodeName, ok := pod.Labels[util.VirtualNodeLabel]
+	if !ok {
+		return c.zone == ""
+	}
+	return nodeName == c.nodeName
+}
@@ -0,0 +1,110 @@
+package providers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/common"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestZoneProviderCapacity(t *testing.T) {
+	options := common.NewProviderConfig()
+	options.ZoneLabel = corev1.LabelTopologyZone
+	inZone := func(zone string) func(*corev1.Node) {
+		return func(node *corev1.Node) { node.Labels[corev1.LabelTopologyZone] = zone }
+	}
+	cl := newTestCluster("test",
+		testNode("a1", "4", inZone("a")),
+		testNode("a2", "4", inZone("a")),
+		testNode("b1", "8", inZone("b")),
+		testNode("u1", "2"),
+	)
+	p := newTestProvider(t, options, cl)
+	startInformers(t, cl)
+
+	tests := []struct {
+		name    string
+		zone    string
+		wantCPU string
+	}{
+		// 主节点只统计没有 zone label 的节点，不重复统计各 zone 的容量
+		{name: "main node", wantCPU: "2"},
+		{name: "zone a", zone: "a", wantCPU: "8"},
+		{name: "zone b", zone: "b", wantCPU: "8"},
+		{name: "unknown zone", zone: "c", wantCPU: "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := p
+			if tt.zone != "" {
+				provider = p.NewZoneProvider(tt.zone)
+			}
+			capacity := provider.clusterCapacity(cl)
+			if want := resource.MustParse(tt.wantCPU); capacity.CPU.Cmp(want) != 0 {
+				t.Fatalf("cpu = %s, want %s", capacity.CPU.String(), tt.wantCPU)
+			}
+		})
+	}
+}
+
+func TestApplyZone(t *testing.T) {
+	options := common.NewProviderConfig()
+	options.ZoneLabel = corev1.LabelTopologyZone
+	p := newTestProvider(t, options)
+
+	tests := []struct {
+		name string
+		zone string
+		want corev1.NodeSelectorRequirement
+	}{
+		{
+			name: "main node",
+			want: corev1.NodeSelectorRequirement{Key: corev1.LabelTopologyZone, Operator: corev1.NodeSelectorOpDoesNotExist},
+		},
+		{
+			name: "zone node",
+			zone: "a",
+			want: corev1.NodeSelectorRequirement{Key: corev1.LabelTopologyZone, Operator: corev1.NodeSelectorOpIn,
+				Values: []string{"a"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := p
+			if tt.zone != "" {
+				provider = p.NewZoneProvider(tt.zone)
+			}
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod"}}
+			provider.applyZone(pod)
+			terms := pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+			if len(terms) != 1 || len(terms[0].MatchExpressions) != 1 {
+				t.Fatalf("unexpected node selector terms %+v", terms)
+			}
+			if got := terms[0].MatchExpressions[0]; !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("requirement = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMainNodeReadyWithoutUnzonedNodes(t *testing.T) {
+	options := common.NewProviderConfig()
+	options.ZoneLabel = corev1.LabelTopologyZone
+	cl := newTestCluster("test", testNode("a1", "4", func(node *corev1.Node) {
+		node.Labels[corev1.LabelTopologyZone] = "a"
+	}))
+	p := newTestProvider(t, options, cl)
+	startInformers(t, cl)
+
+	if capacity := p.clusterCapacity(cl); !capacity.CPU.IsZero() {
+		t.Fatalf("main node cpu = %s, want 0", capacity.CPU.String())
+	}
+	for _, condition := range p.nodeConditions(nil) {
+		if condition.Type == corev1.NodeReady && condition.Status != corev1.ConditionTrue {
+			t.Fatalf("main node not ready: %s", condition.Message)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	octrace "go.opencensus.io/trace"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// exportInterval 批量上报 span 的周期
+	exportInterval = 5 * time.Second
+	// maxQueuedSpans 等待上报的 span 上限，collector 不可用时丢弃更早的 span
+	maxQueuedSpans = 2048
+)
+
+// otlpExporter 通过 OTLP/HTTP 的 JSON 编码将 span 批量上报到 collector 的 /v1/traces
+type otlpExporter struct {
+	url         string
+	serviceName string
+	client      *http.Client
+	logger      log.Logger
+
+	lock  sync.Mutex
+	spans []*octrace.SpanData
+}
+
+func newOTLPExporter(endpoint, serviceName string, logger log.Logger) *otlpExporter {
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		url = "http://" + url
+	}
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	return &otlpExporter{
+		url:         url,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		logger:      logger,
+	}
+}
+
+// ExportSpan 实现 opencensus 的 Exporter，只缓存 span，由 run 批量上报
+func (e *otlpExporter) ExportSpan(s *octrace.SpanData) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if len(e.spans) >= maxQueuedSpans {
+		e.spans = e.spans[1:]
+	}
+	e.spans = append(e.spans, s)
+}
+
+// run 周期性上报缓存的 span，ctx 结束时再上报一次
+func (e *otlpExporter) run(ctx context.Context) {
+	wait.Until(e.flush, exportInterval, ctx.Done())
+	e.flush()
+}
+
+func (e *otlpExporter) flush() {
+	e.lock.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.lock.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	if err := e.post(spans); err != nil {
+		e.logger.WithError(err).WithField("spans", len(spans)).Warnf("Export spans to %s failed", e.url)
+	}
+}
+
+func (e *otlpExporter) post(spans []*octrace.SpanData) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// 以下类型对应 OTLP ExportTraceServiceRequest 的 JSON 编码，trace id 和 span id 使用十六进制
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope  `json:"scope"`
+	Spans []span `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type span struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	Status            status     `json:"status"`
+}
+
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// OTLP 的 span kind 和 status code
+const (
+	kindInternal = 1
+	kindServer   = 2
+	kindClient   = 3
+
+	statusOK    = 1
+	statusError = 2
+)
+
+func (e *otlpExporter) request(spans []*octrace.SpanData) exportRequest {
+	converted := make([]span, 0, len(spans))
+	for _, s := range spans {
+		converted = append(converted, convertSpan(s))
+	}
+	return exportRequest{ResourceSpans: []resourceSpans{{
+		Resource:   resource{Attributes: []keyValue{attribute("service.name", e.serviceName)}},
+		ScopeSpans: []scopeSpans{{Scope: scope{Name: instrumentationName}, Spans: converted}},
+	}}}
+}
+
+func convertSpan(s *octrace.SpanData) span {
+	out := span{
+		TraceID:           hex.EncodeToString(s.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.SpanID[:]),
+		Name:              s.Name,
+		Kind:              kindInternal,
+		StartTimeUnixNano: strconv.FormatInt(s.StartTime.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+		Status:            status{Code: statusOK},
+	}
+	if s.ParentSpanID != (octrace.SpanID{}) {
+		out.ParentSpanID = hex.EncodeToString(s.ParentSpanID[:])
+	}
+	switch s.SpanKind {
+	case octrace.SpanKindServer:
+		out.Kind = kindServer
+	case octrace.SpanKindClient:
+		out.Kind = kindClient
+	}
+	if s.Code != octrace.StatusCodeOK {
+		out.Status = status{Code: statusError, Message: s.Message}
+	}
+	for key, value := range s.Attributes {
+		out.Attributes = append(out.Attributes, attribute(key, value))
+	}
+	return out
+}
+
+// attribute 转换 opencensus 的属性，其取值只会是 string、bool、int64 或 float64，OTLP 的 int64 按 JSON 编码为字符串
+func attribute(key string, value interface{}) keyValue {
+	switch v := value.(type) {
+	case bool:
+		return keyValue{Key: key, Value: anyValue{BoolValue: &v}}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return keyValue{Key: key, Value: anyValue{IntValue: &s}}
+	case float64:
+		return keyValue{Key: key, Value: anyValue{DoubleValue: &v}}
+	default:
+		s := fmt.Sprint(v)
+		return keyValue{Key: key, Value: anyValue{StringValue: &s}}
+	}
+}
@@ -0,0 +1,124 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	"github.com/virtual-kubelet/virtual-kubelet/trace/opencensus"
+	octrace "go.opencensus.io/trace"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	requests := make(chan exportRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		var req exportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		requests <- req
+	}))
+	defer collector.Close()
+
+	exporter := newOTLPExporter(collector.URL, "cas-vk", log.L)
+	octrace.RegisterExporter(exporter)
+	defer octrace.UnregisterExporter(exporter)
+	tracer := trace.T
+	trace.T = opencensus.Adapter{}
+	defer func() { trace.T = tracer }()
+
+	ctx, _ := octrace.StartSpan(context.Background(), "root", octrace.WithSampler(octrace.AlwaysSample()))
+	ctx, podSpan := StartPodSpan(ctx, "CasProvider.CreatePod", "default", "nginx")
+	ctx = podSpan.WithField(ctx, AttrCluster, "c1")
+	_, clientSpan := StartClientSpan(ctx, "client.POST", octrace.StringAttribute(AttrCluster, "c1"))
+	EndClientSpan(clientSpan, http.StatusForbidden, errForbidden)
+	podSpan.End()
+	exporter.flush()
+
+	req := <-requests
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected request %+v", req)
+	}
+	if got := attributes(req.ResourceSpans[0].Resource.Attributes)["service.name"]; got != "cas-vk" {
+		t.Errorf("service.name = %q, want cas-vk", got)
+	}
+	spans := map[string]span{}
+	for _, s := range req.ResourceSpans[0].ScopeSpans[0].Spans {
+		spans[s.Name] = s
+	}
+	pod, client := spans["CasProvider.CreatePod"], spans["client.POST"]
+	if len(spans) != 2 || pod.SpanID == "" || client.SpanID == "" {
+		t.Fatalf("unexpected spans %+v", spans)
+	}
+
+	if pod.Kind != kindInternal || pod.Status.Code != statusOK || pod.ParentSpanID == "" {
+		t.Errorf("unexpected pod span %+v", pod)
+	}
+	if attrs := attributes(pod.Attributes); attrs[AttrNamespace] != "default" || attrs[AttrPod] != "nginx" ||
+		attrs[AttrCluster] != "c1" {
+		t.Errorf("pod span attributes = %v", attrs)
+	}
+
+	if client.ParentSpanID != pod.SpanID || client.TraceID != pod.TraceID {
+		t.Errorf("client span parent = %s/%s, want %s/%s", client.TraceID, client.ParentSpanID, pod.TraceID, pod.SpanID)
+	}
+	if client.Kind != kindClient {
+		t.Errorf("client span kind = %d, want %d", client.Kind, kindClient)
+	}
+	if client.Status.Code != statusError || client.Status.Message != errForbidden.Error() {
+		t.Errorf("client span status = %+v", client.Status)
+	}
+	if attrs := attributes(client.Attributes); attrs[AttrCluster] != "c1" || attrs["status"] != "403" {
+		t.Errorf("client span attributes = %v", attrs)
+	}
+}
+
+var errForbidden = errors.New("forbidden")
+
+// attributes 将属性转换为字符串，便于比较
+func attributes(kvs []keyValue) map[string]string {
+	attrs := map[string]string{}
+	for _, kv := range kvs {
+		switch {
+		case kv.Value.StringValue != nil:
+			attrs[kv.Key] = *kv.Value.StringValue
+		case kv.Value.IntValue != nil:
+			attrs[kv.Key] = *kv.Value.IntValue
+		case kv.Value.BoolValue != nil:
+			attrs[kv.Key] = strconv.FormatBool(*kv.Value.BoolValue)
+		case kv.Value.DoubleValue != nil:
+			attrs[kv.Key] = strconv.FormatFloat(*kv.Value.DoubleValue, 'g', -1, 64)
+		}
+	}
+	return attrs
+}
+
+func TestAttribute(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{value: "c1", want: `{"key":"k","value":{"stringValue":"c1"}}`},
+		{value: true, want: `{"key":"k","value":{"boolValue":true}}`},
+		{value: int64(3), want: `{"key":"k","value":{"intValue":"3"}}`},
+		{value: 0.5, want: `{"key":"k","value":{"doubleValue":0.5}}`},
+	}
+	for _, tt := range tests {
+		got, err := json.Marshal(attribute("k", tt.value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("attribute(%v) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/logging"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	"github.com/virtual-kubelet/virtual-kubelet/trace/opencensus"
+	octrace "go.opencensus.io/trace"
+)
+
+// instrumentationName 上报 span 时的 instrumentation scope
+const instrumentationName = "github.com/practice/virtual-kubelet-practice"
+
+// 与 virtual-kubelet 的日志字段保持一致的 span 属性
+const (
+	AttrNamespace = "namespace"
+	AttrPod       = "name"
+	AttrCluster   = "cluster"
+)
+
+// Setup 将 provider 和 virtual-kubelet 的 span 按 sampleRate 采样后上报到 endpoint 上的 OTLP/HTTP collector，
+// 直到 ctx 结束。endpoint 为空时不上报，span 仍然是 no-op
+func Setup(ctx context.Context, endpoint, serviceName string, sampleRate float64) {
+	if endpoint == "" {
+		return
+	}
+	logger := logging.G(ctx, logging.Telemetry)
+	exporter := newOTLPExporter(endpoint, serviceName, logger)
+	octrace.RegisterExporter(exporter)
+	octrace.ApplyConfig(octrace.Config{DefaultSampler: octrace.ProbabilitySampler(sampleRate)})
+	trace.T = opencensus.Adapter{}
+	go exporter.run(ctx)
+	logger.WithField("sampleRate", sampleRate).Infof("Export traces to %s", exporter.url)
+}
+
+// InSpan 返回 ctx 中是否有 span，informer 的 list/watch 等后台请求不在任何 span 中
+func InSpan(ctx context.Context) bool {
+	return octrace.FromContext(ctx) != nil
+}
+
+// StartClientSpan 创建 kind 为 client 的 span，用于发往下游 apiserver 的请求。
+// virtual-kubelet 的 trace 接口不能指定 span kind，因此直接使用 opencensus
+func StartClientSpan(ctx context.Context, name string, attrs ...octrace.Attribute) (context.Context, *octrace.Span) {
+	ctx, span := octrace.StartSpan(ctx, name, octrace.WithSpanKind(octrace.SpanKindClient))
+	span.AddAttributes(attrs...)
+	return ctx, span
+}
+
+// EndClientSpan 记录响应的状态码后结束 span，err 不为 nil 时将 span 标记为失败
+func EndClientSpan(span *octrace.Span, code int, err error) {
+	span.AddAttributes(octrace.Int64Attribute("status", int64(code)))
+	if err != nil {
+		span.SetStatus(octrace.Status{Code: octrace.StatusCodeUnknown, Message: err.Error()})
+	}
+	span.End()
+}
+
+// Annotate 只为 span 添加属性，用于之后不再需要 span 的日志字段的地方，避免对 ctx 的无效赋值
+func Annotate(span trace.Span, key string, value interface{}) {
+	span.WithField(context.Background(), key, value)
+}
+
+// StartPodSpan 创建与 pod 相关的 span，pod 的 namespace 和 name 同时作为 span 属性和日志字段
+func StartPodSpan(ctx context.Context, name, namespace, pod string) (context.Context, trace.Span) {
+	ctx, span := trace.StartSpan(ctx, name)
+	ctx = span.WithField(ctx, AttrNamespace, namespace)
+	ctx = span.WithField(ctx, AttrPod, pod)
+	return ctx, span
+}
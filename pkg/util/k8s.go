@@ -17,8 +17,14 @@ const (
 	BetaHostNameKey = "beta.kubernetes.io/hostname"
 	// LabelOSBeta is the label of os
 	LabelOSBeta = "beta.kubernetes.io/os"
+	// LabelArchBeta is the label of architecture
+	LabelArchBeta = "beta.kubernetes.io/arch"
 	// VirtualPodLabel is the label of virtual pod
 	VirtualPodLabel = "virtual-pod"
+	// UpstreamPodUID is the annotation recording the UID of the upstream pod of a virtual pod
+	UpstreamPodUID = "virtual-kubelet.io/upstream-uid"
+	// VirtualNodeLabel is the label of the virtual node a virtual pod belongs to
+	VirtualNodeLabel = "virtual-node"
 	// VirtualKubeletLabel is the label of virtual kubelet
 	VirtualKubeletLabel = "virtual-kubelet"
 	// TrippedLabels is the label of tripped labels
@@ -39,6 +45,8 @@ const (
 	// and feature-gate for TaintBasedEvictions flag is enabled,
 	// and removed when node becomes reachable (NodeReady status ConditionTrue).
 	TaintNodeUnreachable = "node.kubernetes.io/unreachable"
+	// TaintNodeUnschedulable will be added when node becomes unschedulable (cordoned)
+	TaintNodeUnschedulable = "node.kubernetes.io/unschedulable"
 	// CreatedbyDescheduler is used to mark if a pod is re-created by descheduler
 	CreatedbyDescheduler = "create-by-descheduler"
 	// DescheduleCount is used for recording deschedule count
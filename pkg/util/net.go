@@ -0,0 +1,47 @@
+package util
+
+import (
+	"net"
+	"os"
+)
+
+const (
+	// PodIPEnv is the env set by downward api to pass the pod ip
+	PodIPEnv = "VKUBELET_POD_IP"
+	// inClusterEnv is set by kubelet for every pod running in a cluster
+	inClusterEnv = "KUBERNETES_SERVICE_HOST"
+	// DefaultInternalIP is used when no address can be detected
+	DefaultInternalIP = "127.0.0.1"
+)
+
+// DetectInternalIP returns the ip the apiserver can reach the virtual kubelet on.
+// It prefers the pod ip passed by downward api, and when running in a cluster falls back
+// to the address of the pod hostname or the first non-loopback interface.
+func DetectInternalIP() string {
+	if ip := os.Getenv(PodIPEnv); net.ParseIP(ip) != nil {
+		return ip
+	}
+	if os.Getenv(inClusterEnv) == "" {
+		return DefaultInternalIP
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		if ips, err := net.LookupIP(hostname); err == nil {
+			for _, ip := range ips {
+				if !ip.IsLoopback() && ip.To4() != nil {
+					return ip.String()
+				}
+			}
+		}
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return DefaultInternalIP
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return ipNet.IP.String()
+		}
+	}
+	return DefaultInternalIP
+}
@@ -0,0 +1,124 @@
+package util
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/common"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// serviceAccountVolumePrefix is the prefix of the projected token volume
+// injected by the upstream apiserver, it is meaningless in the downstream cluster
+const serviceAccountVolumePrefix = "kube-api-access-"
+
+// TrimPod returns a copy of the upstream pod which can be created in the downstream cluster
+func TrimPod(pod *corev1.Pod) *corev1.Pod {
+	podCopy := pod.DeepCopy()
+	labels := podCopy.Labels
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	// 记录上游 pod 所在的虚拟节点，已经转发过的下游 pod 的 NodeName 是下游节点，不能覆盖
+	if !IsVirtualPod(pod) && podCopy.Spec.NodeName != "" {
+		labels[VirtualNodeLabel] = podCopy.Spec.NodeName
+	}
+	labels[VirtualPodLabel] = "true"
+	annotations := podCopy.Annotations
+	// 记录上游 pod 的 UID，用于在上游 pod 上记录事件
+	if !IsVirtualPod(pod) && pod.UID != "" {
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[UpstreamPodUID] = string(pod.UID)
+	}
+
+	trimmed := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        podCopy.Name,
+			Namespace:   podCopy.Namespace,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec: podCopy.Spec,
+	}
+	trimmed.Spec.NodeName = ""
+	trimmed.Spec.Volumes, trimmed.Spec.Containers, trimmed.Spec.InitContainers =
+		trimServiceAccountVolumes(trimmed.Spec.Volumes, trimmed.Spec.Containers, trimmed.Spec.InitContainers)
+	return trimmed
+}
+
+// trimServiceAccountVolumes drops the upstream service account token volumes and their mounts
+func trimServiceAccountVolumes(volumes []corev1.Volume, containers, initContainers []corev1.Container) (
+	[]corev1.Volume, []corev1.Container, []corev1.Container) {
+	removed := map[string]bool{}
+	var kept []corev1.Volume
+	for _, v := range volumes {
+		if strings.HasPrefix(v.Name, serviceAccountVolumePrefix) {
+			removed[v.Name] = true
+			continue
+		}
+		kept = append(kept, v)
+	}
+	if len(removed) == 0 {
+		return volumes, containers, initContainers
+	}
+	trimMounts := func(cs []corev1.Container) {
+		for i := range cs {
+			var mounts []corev1.VolumeMount
+			for _, m := range cs[i].VolumeMounts {
+				if !removed[m.Name] {
+					mounts = append(mounts, m)
+				}
+			}
+			cs[i].VolumeMounts = mounts
+		}
+	}
+	trimMounts(containers)
+	trimMounts(initContainers)
+	return kept, containers, initContainers
+}
+
+// GetDescheduleCount returns how many times a pod has been re-created by descheduler
+func GetDescheduleCount(pod *corev1.Pod) int {
+	if pod.Annotations == nil {
+		return 0
+	}
+	count, err := strconv.Atoi(pod.Annotations[DescheduleCount])
+	if err != nil {
+		return 0
+	}
+	return count
+}
+
+// IsPodUnschedulable returns if the scheduler has marked the pod as unschedulable
+func IsPodUnschedulable(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodScheduled &&
+			condition.Status == corev1.ConditionFalse &&
+			condition.Reason == corev1.PodReasonUnschedulable {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRequestFromPod returns the resources requested by the pod as kube-scheduler computes them:
+// the sum of the containers, raised to the max of each init container since they run one
+// by one, plus the pod overhead. Sidecar init containers (restartPolicy: Always) are out of
+// scope: the core/v1 API vendored here predates them and drops the field when decoding, so
+// they are accounted as regular init containers until k8s.io/api is upgraded.
+func GetRequestFromPod(pod *corev1.Pod) *common.Resource {
+	request := common.NewResource()
+	for _, container := range pod.Spec.Containers {
+		request.Add(common.ConvertResource(container.Resources.Requests))
+	}
+	for _, container := range pod.Spec.InitContainers {
+		request.SetMax(common.ConvertResource(container.Resources.Requests))
+	}
+	if pod.Spec.Overhead != nil {
+		request.Add(common.ConvertResource(pod.Spec.Overhead))
+	}
+	return request
+}
@@ -0,0 +1,112 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/common"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func requests(pairs ...string) corev1.ResourceRequirements {
+	list := corev1.ResourceList{}
+	for i := 0; i < len(pairs); i += 2 {
+		list[corev1.ResourceName(pairs[i])] = resource.MustParse(pairs[i+1])
+	}
+	return corev1.ResourceRequirements{Requests: list}
+}
+
+func TestGetRequestFromPod(t *testing.T) {
+	tests := []struct {
+		name string
+		spec corev1.PodSpec
+		want corev1.ResourceList
+	}{
+		{
+			name: "containers are summed",
+			spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{Resources: requests("cpu", "1", "memory", "1Gi")},
+					{Resources: requests("cpu", "500m", "memory", "512Mi")},
+				},
+			},
+			want: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("1500m"),
+				corev1.ResourceMemory: resource.MustParse("1536Mi"),
+			},
+		},
+		{
+			name: "init containers raise to their max",
+			spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{
+					{Resources: requests("cpu", "2")},
+					{Resources: requests("cpu", "500m", "memory", "4Gi")},
+				},
+				Containers: []corev1.Container{
+					{Resources: requests("cpu", "1", "memory", "1Gi")},
+				},
+			},
+			want: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("2"),
+				corev1.ResourceMemory: resource.MustParse("4Gi"),
+			},
+		},
+		{
+			name: "overhead is added after the init container max",
+			spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{
+					{Resources: requests("cpu", "2")},
+				},
+				Containers: []corev1.Container{
+					{Resources: requests("cpu", "1")},
+				},
+				Overhead: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("250m")},
+			},
+			want: corev1.ResourceList{
+				corev1.ResourceCPU: resource.MustParse("2250m"),
+			},
+		},
+		{
+			name: "hugepages are accounted separately from memory",
+			spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{
+					{Resources: requests("hugepages-2Mi", "1Gi")},
+				},
+				Containers: []corev1.Container{
+					{Resources: requests("memory", "1Gi", "hugepages-2Mi", "256Mi", "hugepages-1Gi", "2Gi")},
+					{Resources: requests("hugepages-2Mi", "256Mi")},
+				},
+			},
+			want: corev1.ResourceList{
+				corev1.ResourceMemory: resource.MustParse("1Gi"),
+				"hugepages-2Mi":       resource.MustParse("1Gi"),
+				"hugepages-1Gi":       resource.MustParse("2Gi"),
+			},
+		},
+		{
+			name: "ephemeral storage",
+			spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{
+					{Resources: requests("ephemeral-storage", "5Gi")},
+				},
+				Containers: []corev1.Container{
+					{Resources: requests("ephemeral-storage", "1Gi")},
+					{Resources: requests("ephemeral-storage", "2Gi")},
+				},
+				Overhead: corev1.ResourceList{corev1.ResourceEphemeralStorage: resource.MustParse("1Gi")},
+			},
+			want: corev1.ResourceList{
+				corev1.ResourceEphemeralStorage: resource.MustParse("6Gi"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := GetRequestFromPod(&corev1.Pod{Spec: tt.spec})
+			want := common.ConvertResource(tt.want)
+			if !got.Equal(want) {
+				t.Fatalf("request = %v, want %v", got.List(), want.List())
+			}
+		})
+	}
+}
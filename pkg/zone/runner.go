@@ -0,0 +1,183 @@
+package zone
+
+import (
+	"context"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/practice/virtual-kubelet-practice/pkg/logging"
+	"github.com/practice/virtual-kubelet-practice/pkg/providers"
+	"github.com/virtual-kubelet/node-cli/opts"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/node"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// discoverInterval 发现新 zone 的周期
+const discoverInterval = 30 * time.Second
+
+// Runner 为下游集群中的每个 zone 启动一个虚拟节点，主节点仍由 node-cli 启动
+type Runner struct {
+	provider *providers.CasProvider
+	client   kubernetes.Interface
+	opts     *opts.Opts
+
+	scmInformerFactory kubeinformers.SharedInformerFactory
+
+	lock    sync.Mutex
+	started map[string]bool
+}
+
+// NewRunner returns a Runner, client is the client of the upstream cluster
+func NewRunner(p *providers.CasProvider, client kubernetes.Interface, o *opts.Opts) *Runner {
+	return &Runner{
+		provider:           p,
+		client:             client,
+		opts:               o,
+		scmInformerFactory: kubeinformers.NewSharedInformerFactoryWithOptions(client, o.InformerResyncPeriod),
+		started:            map[string]bool{},
+	}
+}
+
+// Run 周期性发现新的 zone 并为其启动虚拟节点，直到 ctx 结束
+func (r *Runner) Run(ctx context.Context) {
+	scm := r.scmInformerFactory.Core().V1()
+	// 提前创建 informer，保证 Start 时会启动它们
+	scm.Secrets().Informer()
+	scm.ConfigMaps().Informer()
+	scm.Services().Informer()
+	r.scmInformerFactory.Start(ctx.Done())
+
+	wait.Until(func() {
+		for _, zone := range r.provider.Zones() {
+			r.lock.Lock()
+			started := r.started[zone]
+			r.started[zone] = true
+			r.lock.Unlock()
+			if started {
+				continue
+			}
+			go func(zone string) {
+				if err := r.runNode(ctx, r.provider.NewZoneProvider(zone)); err != nil {
+					logging.G(ctx, logging.Zone).WithError(err).WithField("zone", zone).Error("Run virtual node of zone failed")
+					r.lock.Lock()
+					delete(r.started, zone)
+					r.lock.Unlock()
+				}
+			}(zone)
+		}
+	}, discoverInterval, ctx.Done())
+}
+
+// runNode 启动 zone 虚拟节点的 node controller 和 pod controller，与 node-cli 启动主节点的流程一致
+func (r *Runner) runNode(ctx context.Context, p *providers.CasProvider) error {
+	nodeName := p.NodeName()
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField(logging.FieldNode, nodeName))
+
+	podInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(
+		r.client,
+		r.opts.InformerResyncPeriod,
+		kubeinformers.WithNamespace(r.opts.KubeNamespace),
+		kubeinformers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", nodeName).String()
+		}))
+	podInformer := podInformerFactory.Core().V1().Pods()
+
+	pNode := r.nodeFromProvider(ctx, p)
+
+	nodeOpts := []node.NodeControllerOpt{
+		node.WithNodeStatusUpdateErrorHandler(func(ctx context.Context, err error) error {
+			if !k8serrors.IsNotFound(err) {
+				return err
+			}
+			newNode := pNode.DeepCopy()
+			newNode.ResourceVersion = ""
+			_, err = r.client.CoreV1().Nodes().Create(ctx, newNode, metav1.CreateOptions{})
+			return err
+		}),
+	}
+	// WithNodeEnableLeaseV1 不接受 nil 的 lease client，未开启 lease 时不能添加
+	if r.opts.EnableNodeLease {
+		leaseClient := r.client.CoordinationV1().Leases(corev1.NamespaceNodeLease)
+		nodeOpts = append(nodeOpts, node.WithNodeEnableLeaseV1(leaseClient, node.DefaultLeaseDuration))
+	}
+	nodeRunner, err := node.NewNodeController(p, pNode, r.client.CoreV1().Nodes(), nodeOpts...)
+	if err != nil {
+		return err
+	}
+
+	eb := record.NewBroadcaster()
+	eb.StartLogging(log.G(ctx).Infof)
+	eb.StartRecordingToSink(&corev1client.EventSinkImpl{Interface: r.client.CoreV1().Events(r.opts.KubeNamespace)})
+
+	scm := r.scmInformerFactory.Core().V1()
+	pc, err := node.NewPodController(node.PodControllerConfig{
+		PodClient:         r.client.CoreV1(),
+		PodInformer:       podInformer,
+		EventRecorder:     eb.NewRecorder(scheme.Scheme, corev1.EventSource{Component: path.Join(nodeName, "pod-controller")}),
+		Provider:          p,
+		SecretInformer:    scm.Secrets(),
+		ConfigMapInformer: scm.ConfigMaps(),
+		ServiceInformer:   scm.Services(),
+	})
+	if err != nil {
+		return err
+	}
+	podInformerFactory.Start(ctx.Done())
+
+	go func() {
+		if err := pc.Run(ctx, r.opts.PodSyncWorkers); err != nil && err != context.Canceled {
+			logging.G(ctx, logging.Zone).WithError(err).Error("Pod controller exited")
+		}
+	}()
+
+	logging.G(ctx, logging.Zone).Info("Start virtual node")
+	return nodeRunner.Run(ctx)
+}
+
+// nodeFromProvider 构造虚拟节点，与 node-cli 中 NodeFromProvider 的行为一致
+func (r *Runner) nodeFromProvider(ctx context.Context, p *providers.CasProvider) *corev1.Node {
+	var taints []corev1.Taint
+	if !r.opts.DisableTaint {
+		taintValue := r.opts.TaintValue
+		if taintValue == "" {
+			taintValue = r.opts.Provider
+		}
+		taints = append(taints, corev1.Taint{
+			Key:    r.opts.TaintKey,
+			Value:  taintValue,
+			Effect: corev1.TaintEffect(r.opts.TaintEffect),
+		})
+	}
+	nodeName := p.NodeName()
+	pNode := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: nodeName,
+			Labels: map[string]string{
+				"type":                   "virtual-kubelet",
+				"kubernetes.io/role":     "agent",
+				"kubernetes.io/hostname": nodeName,
+			},
+		},
+		Spec: corev1.NodeSpec{
+			Taints: taints,
+		},
+		Status: corev1.NodeStatus{
+			NodeInfo: corev1.NodeSystemInfo{
+				KubeletVersion: r.opts.Version,
+			},
+		},
+	}
+	p.ConfigureNode(ctx, pNode)
+	return pNode
+}